@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	dayFormat         = "2006-01-02"
+	maxDashboardDays  = 366
+	defaultDashboard  = 30 // days shown when no range is given
+	defaultTopPosts   = 10
+	viewQueueCapacity = 4096
+)
+
+// viewEvent is one page view, handed from the request to the aggregator
+type viewEvent struct {
+	BlogId   string
+	Visitor  string // hashed, see visitorID
+	Referrer string
+	At       time.Time
+}
+
+// dayStats are the views of one post on one day. Visitors is only kept to
+// count each visitor once while the day lasts, closeDays folds it into
+// Unique afterwards.
+type dayStats struct {
+	Views     int
+	Visitors  map[string]bool
+	Unique    int
+	Referrers map[string]int
+}
+
+func (s *dayStats) uniqueVisitors() int {
+	if s.Visitors == nil {
+		return s.Unique
+	}
+	return len(s.Visitors)
+}
+
+type DayCount struct {
+	Date           string `json:"date"`
+	Views          int    `json:"views"`
+	UniqueVisitors int    `json:"unique_visitors"`
+}
+
+type PostStats struct {
+	Id          string     `json:"id"`
+	Title       string     `json:"title"`
+	Views       int        `json:"views"`
+	VisitorDays int        `json:"visitor_days"` // unique visitors summed over days, someone back the next day counts twice
+	Days        []DayCount `json:"days,omitempty"`
+}
+
+type ReferrerCount struct {
+	Referrer string `json:"referrer"`
+	Views    int    `json:"views"`
+}
+
+type Dashboard struct {
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Views       int             `json:"views"`
+	VisitorDays int             `json:"visitor_days"` // summed over posts and days, see PostStats
+	Posts       []PostStats     `json:"posts"`
+	TopPosts    []PostStats     `json:"top_posts"`
+	Referrers   []ReferrerCount `json:"referrers"`
+}
+
+var (
+	// views are queued so that counting never slows down or blocks a read.
+	// When the aggregator falls this far behind, views are dropped.
+	viewQueue = make(chan viewEvent, viewQueueCapacity)
+
+	// stats by blog id and day, guarded by statsMutex so the dashboard can
+	// read them without holding the mutex
+	stats      = make(map[string]map[string]*dayStats)
+	statsMutex = &sync.Mutex{}
+
+	// visitorSalt makes visitor hashes useless outside this process
+	visitorSalt = newVisitorSalt()
+)
+
+func newVisitorSalt() []byte {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return salt
+}
+
+// visitorID identifies a reader without storing who they are. Signed in
+// readers are their user name, others a hash of address and browser that
+// changes every day.
+func visitorID(c *fiber.Ctx, now time.Time) string {
+	if username := currentUser(c); username != "" {
+		return "user:" + username
+	}
+	sum := sha256.Sum256([]byte(string(visitorSalt) + "|" + now.UTC().Format(dayFormat) + "|" + c.IP() + "|" + c.Get(fiber.HeaderUserAgent)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// referrerHost reduces the Referer header to a host, "direct" when there is
+// none and "internal" for links from this site
+func referrerHost(c *fiber.Ctx) string {
+	ref, err := url.Parse(c.Get(fiber.HeaderReferer))
+	if err != nil || ref.Hostname() == "" {
+		return "direct"
+	}
+	if ref.Hostname() == c.Hostname() || ref.Host == c.Hostname() {
+		return "internal"
+	}
+	return strings.TrimPrefix(strings.ToLower(ref.Hostname()), "www.")
+}
+
+func isBot(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, marker := range []string{"bot", "crawler", "spider"} {
+		if strings.Contains(userAgent, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordView queues a view of a published post. Authors reading their own
+// post and bots are not counted. Caller must hold the mutex.
+func recordView(c *fiber.Ctx, blog Blog) {
+	if blog.Status != StatusPublished || isAuthor(currentUser(c), blog) || isBot(c.Get(fiber.HeaderUserAgent)) {
+		return
+	}
+	now := time.Now()
+	event := viewEvent{BlogId: blog.Id, Visitor: visitorID(c, now), Referrer: referrerHost(c), At: now}
+	select {
+	case viewQueue <- event:
+	default: // full, drop rather than make the reader wait
+	}
+}
+
+// runAnalytics adds queued views to the daily stats. It takes the mutex
+// too, so a post deleted while its views were queued stays forgotten.
+func runAnalytics() {
+	today := time.Now().UTC().Format(dayFormat)
+	for event := range viewQueue {
+		mutex.Lock()
+		statsMutex.Lock()
+		if day := event.At.UTC().Format(dayFormat); day > today {
+			today = day
+			closeDays(today)
+		}
+		countView(event)
+		statsMutex.Unlock()
+		mutex.Unlock()
+	}
+}
+
+// countView adds one view of a post that still exists, caller must hold the
+// mutex and statsMutex
+func countView(event viewEvent) {
+	if _, exists := blogs[event.BlogId]; !exists {
+		return
+	}
+	days, exists := stats[event.BlogId]
+	if !exists {
+		days = make(map[string]*dayStats)
+		stats[event.BlogId] = days
+	}
+	day := event.At.UTC().Format(dayFormat)
+	s, exists := days[day]
+	if !exists {
+		s = &dayStats{Visitors: make(map[string]bool), Referrers: make(map[string]int)}
+		days[day] = s
+	}
+	s.Views++
+	if s.Visitors != nil {
+		s.Visitors[event.Visitor] = true
+	} // else a late view of a closed day, its visitor can't be told apart any more
+	s.Referrers[event.Referrer]++
+}
+
+// closeDays keeps only the number of visitors of the days before today,
+// caller must hold statsMutex
+func closeDays(today string) {
+	for _, days := range stats {
+		for day, s := range days {
+			if day < today && s.Visitors != nil {
+				s.Unique, s.Visitors = len(s.Visitors), nil
+			}
+		}
+	}
+}
+
+// forgetStats drops the stats of a deleted post
+func forgetStats(blogID string) {
+	statsMutex.Lock()
+	delete(stats, blogID)
+	statsMutex.Unlock()
+}
+
+// parseDashboardRange reads ?from= and ?to= as UTC days, both included.
+// Without them it covers the last 30 days.
+func parseDashboardRange(c *fiber.Ctx) (time.Time, time.Time, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	to, from := today, today.AddDate(0, 0, 1-defaultDashboard)
+	var err error
+	if value := c.Query("to"); value != "" {
+		if to, err = time.Parse(dayFormat, value); err != nil {
+			return from, to, errors.New("to must be a date like 2024-01-31")
+		}
+		from = to.AddDate(0, 0, 1-defaultDashboard)
+	}
+	if value := c.Query("from"); value != "" {
+		if from, err = time.Parse(dayFormat, value); err != nil {
+			return from, to, errors.New("from must be a date like 2024-01-31")
+		}
+	}
+	if to.Before(from) {
+		return from, to, errors.New("from must not be after to")
+	}
+	if to.Sub(from) >= maxDashboardDays*24*time.Hour {
+		return from, to, errors.New("the range can cover at most " + strconv.Itoa(maxDashboardDays) + " days")
+	}
+	return from, to, nil
+}
+
+// GetDashboard shows how the caller's posts did between ?from= and ?to=:
+// views per post per day, referrers and the ?top= most read posts. Editors
+// can look at another author with ?author=.
+func GetDashboard(c *fiber.Ctx) error {
+	from, to, err := parseDashboardRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	top, err := strconv.Atoi(c.Query("top", strconv.Itoa(defaultTopPosts)))
+	if err != nil || top < 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "top must be a positive number"})
+	}
+
+	author := currentUser(c)
+	mutex.Lock()
+	if requested := c.Query("author"); requested != "" && requested != author {
+		if !isEditor(author) {
+			mutex.Unlock()
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors can see the stats of other authors"})
+		}
+		author = requested
+	}
+	var posts []Blog
+	for _, blog := range blogs {
+		if isAuthor(author, blog) && !blog.PublishedAt.IsZero() {
+			posts = append(posts, blog)
+		}
+	}
+	mutex.Unlock()
+
+	dashboard := Dashboard{
+		From:      from.Format(dayFormat),
+		To:        to.Format(dayFormat),
+		Posts:     []PostStats{},
+		Referrers: []ReferrerCount{},
+	}
+	referrers := make(map[string]int)
+
+	statsMutex.Lock()
+	for _, blog := range posts {
+		post := PostStats{Id: blog.Id, Title: blog.Title, Days: []DayCount{}}
+		for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+			count := DayCount{Date: day.Format(dayFormat)}
+			if s, exists := stats[blog.Id][count.Date]; exists {
+				count.Views, count.UniqueVisitors = s.Views, s.uniqueVisitors()
+				for referrer, views := range s.Referrers {
+					referrers[referrer] += views
+				}
+			}
+			post.Views += count.Views
+			post.VisitorDays += count.UniqueVisitors
+			post.Days = append(post.Days, count)
+		}
+		dashboard.Views += post.Views
+		dashboard.VisitorDays += post.VisitorDays
+		dashboard.Posts = append(dashboard.Posts, post)
+	}
+	statsMutex.Unlock()
+
+	for referrer, views := range referrers {
+		dashboard.Referrers = append(dashboard.Referrers, ReferrerCount{Referrer: referrer, Views: views})
+	}
+	sort.Slice(dashboard.Referrers, func(i, j int) bool {
+		if dashboard.Referrers[i].Views != dashboard.Referrers[j].Views {
+			return dashboard.Referrers[i].Views > dashboard.Referrers[j].Views
+		}
+		return dashboard.Referrers[i].Referrer < dashboard.Referrers[j].Referrer
+	})
+
+	sort.Slice(dashboard.Posts, func(i, j int) bool {
+		a, b := dashboard.Posts[i], dashboard.Posts[j]
+		if a.VisitorDays != b.VisitorDays {
+			return a.VisitorDays > b.VisitorDays
+		}
+		if a.Views != b.Views {
+			return a.Views > b.Views
+		}
+		return a.Title < b.Title
+	})
+	for _, post := range dashboard.Posts {
+		if len(dashboard.TopPosts) == top || post.Views == 0 {
+			break
+		}
+		post.Days = nil // already in posts
+		dashboard.TopPosts = append(dashboard.TopPosts, post)
+	}
+	if dashboard.TopPosts == nil {
+		dashboard.TopPosts = []PostStats{}
+	}
+
+	return c.JSON(dashboard)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gosimple/slug"
+)
+
+// Category is a node of the category tree, posts belong to at most one
+type Category struct {
+	Slug   string `json:"slug" yaml:"slug"`
+	Name   string `json:"name" yaml:"name"`
+	Parent string `json:"parent,omitempty" yaml:"parent,omitempty"` // slug of the parent, empty for top level
+}
+
+// CategoryNode is a category with its post counts and subcategories. Count
+// is the posts filed directly under it, Total includes subcategories.
+type CategoryNode struct {
+	Category
+	Count    int             `json:"count"`
+	Total    int             `json:"total"`
+	Children []*CategoryNode `json:"children"`
+}
+
+var categories = make(map[string]Category)
+
+// inCategory tells whether a post filed under category falls under root,
+// directly or through a subcategory. Caller must hold the mutex.
+func inCategory(category, root string) bool {
+	for ; category != ""; category = categories[category].Parent {
+		if category == root {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateCategory adds a category, editors only
+func CreateCategory(c *fiber.Ctx) error {
+	category := new(Category)
+	if err := c.BodyParser(category); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	category.Slug = slug.Make(category.Name)
+	if category.Slug == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name is required"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isEditor(currentUser(c)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors can manage categories"})
+	}
+	if _, exists := categories[category.Slug]; exists {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "category already exists"})
+	}
+	if _, exists := categories[category.Parent]; category.Parent != "" && !exists {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "parent category not found"})
+	}
+
+	categories[category.Slug] = *category
+	return c.Status(fiber.StatusCreated).JSON(category)
+}
+
+// GetCategories returns the category tree with published post counts
+func GetCategories(c *fiber.Ctx) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	nodes := make(map[string]*CategoryNode)
+	for slug, category := range categories {
+		nodes[slug] = &CategoryNode{Category: category, Children: []*CategoryNode{}}
+	}
+	// a post or category can point at a category that is gone, it is left
+	// out rather than trusted
+	for _, blog := range blogs {
+		if blog.Status != StatusPublished {
+			continue
+		}
+		if node, ok := nodes[blog.Category]; ok {
+			node.Count++
+		}
+		for node, ok := nodes[blog.Category]; ok; node, ok = nodes[node.Parent] {
+			node.Total++
+		}
+	}
+
+	roots := []*CategoryNode{}
+	for _, node := range nodes {
+		if parent, ok := nodes[node.Parent]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	for _, node := range nodes {
+		sortCategoryNodes(node.Children)
+	}
+	sortCategoryNodes(roots)
+
+	return c.JSON(roots)
+}
+
+func sortCategoryNodes(nodes []*CategoryNode) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+}
+
+// DeleteCategory removes a category, its subcategories and posts move up to
+// its parent. Editors only.
+func DeleteCategory(c *fiber.Ctx) error {
+	categorySlug := c.Params("slug")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isEditor(currentUser(c)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors can manage categories"})
+	}
+	category, exists := categories[categorySlug]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "category not found"})
+	}
+
+	for slug, child := range categories {
+		if child.Parent == categorySlug {
+			child.Parent = category.Parent
+			categories[slug] = child
+		}
+	}
+	for id, blog := range blogs {
+		if blog.Category == categorySlug {
+			blog.Category = category.Parent
+			blogs[id] = blog
+		}
+	}
+	delete(categories, categorySlug)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
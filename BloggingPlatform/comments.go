@@ -0,0 +1,415 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	CommentApproved = "approved"
+	CommentPending  = "pending"
+	CommentRejected = "rejected"
+	CommentDeleted  = "deleted" // kept as a placeholder while it still has replies
+)
+
+// replies nested deeper than this are refused
+const maxCommentDepth = 8
+
+type Comment struct {
+	Id        string    `json:"id"`
+	BlogId    string    `json:"blog_id"`
+	ParentId  string    `json:"parent_id,omitempty"`
+	Author    string    `json:"author"`
+	Content   string    `json:"content"`
+	Status    string    `json:"status"`
+	HeldFor   string    `json:"held_for,omitempty"` // why a pending comment waits: first_comment or blocklist
+	Date      time.Time `json:"date"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CommentRequest struct {
+	Content  string `json:"content"`
+	ParentId string `json:"parent_id"`
+}
+
+// CommentThread is a comment with its visible replies
+type CommentThread struct {
+	Comment
+	Replies []*CommentThread `json:"replies"`
+}
+
+var (
+	comments = make(map[string]Comment)
+	// words and phrases that send a comment to the moderation queue, starts
+	// from COMMENT_BLOCKLIST (comma or newline separated) and editors can replace it
+	blocklist = parseBlocklist(os.Getenv("COMMENT_BLOCKLIST"))
+	// blocklist compiled by compileBlocklist, replaced along with it
+	blocklistPatterns = compileBlocklist(blocklist)
+)
+
+// parseBlocklist reads terms separated by commas or newlines, blank ones are
+// dropped
+func parseBlocklist(raw string) []string {
+	result := []string{}
+	separator := func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }
+	for _, term := range strings.FieldsFunc(raw, separator) {
+		term = strings.ToLower(strings.TrimSpace(term))
+		if term != "" {
+			result = append(result, term)
+		}
+	}
+	return result
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// compileBlocklist turns terms into patterns that match whole words, so "ass"
+// doesn't hold "class". A term starting or ending with a symbol, like "c++",
+// has no word boundary on that side.
+func compileBlocklist(terms []string) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0, len(terms))
+	for _, term := range terms {
+		pattern := regexp.QuoteMeta(term)
+		if isWordByte(term[0]) {
+			pattern = `\b` + pattern
+		}
+		if isWordByte(term[len(term)-1]) {
+			pattern += `\b`
+		}
+		patterns = append(patterns, regexp.MustCompile(`(?i)`+pattern))
+	}
+	return patterns
+}
+
+// blocked tells whether content contains a blocklisted word or phrase
+func blocked(content string) bool {
+	for _, pattern := range blocklistPatterns {
+		if pattern.MatchString(content) {
+			return true
+		}
+	}
+	return false
+}
+
+// moderate sets the status of a new or edited comment. Editors are never
+// held, everyone else waits for approval on their first comment and
+// whenever they hit the blocklist. An approved comment that is edited counts
+// as an earlier approval itself. Caller must hold the mutex.
+func moderate(comment *Comment) {
+	wasApproved := comment.Status == CommentApproved
+	comment.Status, comment.HeldFor = CommentApproved, ""
+	if isEditor(comment.Author) {
+		return
+	}
+	if blocked(comment.Content) {
+		comment.Status, comment.HeldFor = CommentPending, "blocklist"
+		return
+	}
+	if wasApproved {
+		return
+	}
+	for _, other := range comments {
+		if other.Author == comment.Author && other.Id != comment.Id && other.Status == CommentApproved {
+			return
+		}
+	}
+	comment.Status, comment.HeldFor = CommentPending, "first_comment"
+}
+
+// canModerate is true for editors and for the authors of the post
+func canModerate(username string, blogID string) bool {
+	return isEditor(username) || isAuthor(username, blogs[blogID])
+}
+
+func commentDepth(comment Comment) int {
+	depth := 0
+	for id := comment.ParentId; id != ""; id = comments[id].ParentId {
+		depth++
+	}
+	return depth
+}
+
+func hasReplies(commentID string) bool {
+	for _, other := range comments {
+		if other.ParentId == commentID {
+			return true
+		}
+	}
+	return false
+}
+
+// removeComment deletes a comment, or blanks it when replies still hang off
+// it. A blanked parent with no replies left goes too.
+func removeComment(comment Comment) {
+	if hasReplies(comment.Id) {
+		comment.Content = ""
+		comment.Status = CommentDeleted
+		comment.UpdatedAt = time.Now()
+		comments[comment.Id] = comment
+		return
+	}
+	delete(comments, comment.Id)
+	if parent, ok := comments[comment.ParentId]; ok && parent.Status == CommentDeleted {
+		removeComment(parent)
+	}
+}
+
+func CreateComment(c *fiber.Ctx) error {
+	blogID := c.Params("id")
+	username := currentUser(c)
+	req := new(CommentRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "content is required"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[blogID]
+	if !exists || !isVisible(username, blog) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	if blog.CommentsLocked {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "comments on this blog are locked"})
+	}
+
+	comment := Comment{
+		Id:       uuid.New().String(),
+		BlogId:   blogID,
+		ParentId: req.ParentId,
+		Author:   username,
+		Content:  req.Content,
+		Date:     time.Now(),
+	}
+	comment.UpdatedAt = comment.Date
+	if req.ParentId != "" {
+		parent, exists := comments[req.ParentId]
+		if !exists || parent.BlogId != blogID || parent.Status != CommentApproved {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "parent comment not found on this blog"})
+		}
+		if commentDepth(comment) > maxCommentDepth {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "replies are nested too deep"})
+		}
+	}
+	moderate(&comment)
+	comments[comment.Id] = comment
+
+	if comment.Status == CommentPending {
+		return c.Status(fiber.StatusAccepted).JSON(comment)
+	}
+	return c.Status(fiber.StatusCreated).JSON(comment)
+}
+
+// GetComments returns the comment tree of a blog. Readers see approved
+// comments and their own pending ones, moderators also see everything
+// pending on the post.
+func GetComments(c *fiber.Ctx) error {
+	blogID := c.Params("id")
+	username := currentUser(c)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if blog, exists := blogs[blogID]; !exists || !isVisible(username, blog) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	moderator := canModerate(username, blogID)
+
+	var visible []Comment
+	for _, comment := range comments {
+		if comment.BlogId != blogID {
+			continue
+		}
+		switch comment.Status {
+		case CommentApproved, CommentDeleted:
+		case CommentPending:
+			if !moderator && comment.Author != username {
+				continue
+			}
+		default:
+			continue
+		}
+		visible = append(visible, comment)
+	}
+	sort.Slice(visible, func(i, j int) bool { return visible[i].Date.Before(visible[j].Date) })
+
+	threads := make(map[string]*CommentThread)
+	for _, comment := range visible {
+		threads[comment.Id] = &CommentThread{Comment: comment, Replies: []*CommentThread{}}
+	}
+	roots := []*CommentThread{}
+	for _, comment := range visible {
+		if parent, ok := threads[comment.ParentId]; ok {
+			parent.Replies = append(parent.Replies, threads[comment.Id])
+		} else if comment.ParentId == "" {
+			roots = append(roots, threads[comment.Id])
+		}
+	}
+
+	return c.JSON(roots)
+}
+
+func UpdateComment(c *fiber.Ctx) error {
+	commentID := c.Params("id")
+	req := new(CommentRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "content is required"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	comment, exists := comments[commentID]
+	if !exists || comment.Status == CommentDeleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "comment not found"})
+	}
+	if comment.Author != currentUser(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author can edit this comment"})
+	}
+	if blogs[comment.BlogId].CommentsLocked {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "comments on this blog are locked"})
+	}
+
+	comment.Content = req.Content
+	comment.UpdatedAt = time.Now()
+	if comment.Status == CommentApproved || comment.Status == CommentPending {
+		moderate(&comment)
+	}
+	comments[commentID] = comment
+
+	return c.JSON(comment)
+}
+
+// DeleteComment is open to the comment author and to moderators of the post
+func DeleteComment(c *fiber.Ctx) error {
+	commentID := c.Params("id")
+	username := currentUser(c)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	comment, exists := comments[commentID]
+	if !exists || comment.Status == CommentDeleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "comment not found"})
+	}
+	if comment.Author != username && !canModerate(username, comment.BlogId) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author or a moderator can delete this comment"})
+	}
+
+	removeComment(comment)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func setCommentsLocked(c *fiber.Ctx, locked bool) error {
+	blogID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[blogID]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	if !canModify(currentUser(c), blog) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author or an editor can lock comments"})
+	}
+
+	blog.CommentsLocked = locked
+	blogs[blogID] = blog
+	return c.JSON(blog)
+}
+
+func LockComments(c *fiber.Ctx) error {
+	return setCommentsLocked(c, true)
+}
+
+func UnlockComments(c *fiber.Ctx) error {
+	return setCommentsLocked(c, false)
+}
+
+// ModerationQueue lists pending comments the caller can moderate, oldest first
+func ModerationQueue(c *fiber.Ctx) error {
+	username := currentUser(c)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	result := []Comment{}
+	for _, comment := range comments {
+		if comment.Status == CommentPending && canModerate(username, comment.BlogId) {
+			result = append(result, comment)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date.Before(result[j].Date) })
+
+	return c.JSON(result)
+}
+
+func reviewComment(c *fiber.Ctx, status string) error {
+	commentID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	comment, exists := comments[commentID]
+	if !exists || comment.Status != CommentPending {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no pending comment with this id"})
+	}
+	if !canModerate(currentUser(c), comment.BlogId) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author of the blog or an editor can moderate"})
+	}
+
+	comment.Status, comment.HeldFor = status, ""
+	comments[commentID] = comment
+	return c.JSON(comment)
+}
+
+func ApproveComment(c *fiber.Ctx) error {
+	return reviewComment(c, CommentApproved)
+}
+
+func RejectComment(c *fiber.Ctx) error {
+	return reviewComment(c, CommentRejected)
+}
+
+func GetBlocklist(c *fiber.Ctx) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isEditor(currentUser(c)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors can see the blocklist"})
+	}
+	return c.JSON(blocklist)
+}
+
+// SetBlocklist replaces the blocklist, comments already posted are not re-checked
+func SetBlocklist(c *fiber.Ctx) error {
+	var terms []string
+	if err := c.BodyParser(&terms); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "body must be a list of words"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isEditor(currentUser(c)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors can change the blocklist"})
+	}
+	blocklist = parseBlocklist(strings.Join(terms, "\n"))
+	blocklistPatterns = compileBlocklist(blocklist)
+	return c.JSON(blocklist)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	feedTitle = "BloggingPlatform"
+	feedSize  = 20 // newest posts per feed
+)
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	SelfLink      atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	Author      string   `xml:"dc:creator"`
+	Categories  []string `xml:"category"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Link       atomLink       `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     atomPerson     `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Content    atomContent    `xml:"content"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"` // escaped HTML
+}
+
+// feedPosts returns the newest published posts that pass filter, newest first,
+// and when the newest of them last changed. Caller must hold the mutex.
+func feedPosts(filter func(Blog) bool) ([]Blog, time.Time) {
+	var posts []Blog
+	for _, blog := range blogs {
+		if blog.Status == StatusPublished && filter(blog) {
+			posts = append(posts, blog)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].PublishedAt.Equal(posts[j].PublishedAt) {
+			return posts[i].PublishedAt.After(posts[j].PublishedAt)
+		}
+		return posts[i].Id < posts[j].Id
+	})
+	if len(posts) > feedSize {
+		posts = posts[:feedSize]
+	}
+
+	var updated time.Time
+	for _, blog := range posts {
+		if blog.UpdatedAt.After(updated) {
+			updated = blog.UpdatedAt
+		}
+		if blog.PublishedAt.After(updated) {
+			updated = blog.PublishedAt
+		}
+	}
+	return posts, updated
+}
+
+func buildRSS(c *fiber.Ctx, title string, posts []Blog, updated time.Time) interface{} {
+	feed := rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        c.BaseURL() + "/",
+			Description: title,
+			SelfLink:    atomLink{Href: c.BaseURL() + c.OriginalURL(), Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	if !updated.IsZero() {
+		feed.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, blog := range posts {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       blog.Title,
+			Link:        c.BaseURL() + "/blog/" + blog.Slug,
+			Description: blog.ContentHTML,
+			Author:      blog.Author,
+			Categories:  blog.Tags,
+			// the id, not the link, because the slug changes with the title
+			GUID:    rssGUID{IsPermaLink: false, Value: "urn:uuid:" + blog.Id},
+			PubDate: blog.PublishedAt.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return feed
+}
+
+func buildAtom(c *fiber.Ctx, title string, posts []Blog, updated time.Time) interface{} {
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+	feed := atomFeed{
+		Title:   title,
+		ID:      c.BaseURL() + c.Path(),
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: c.BaseURL() + c.OriginalURL(), Rel: "self", Type: "application/atom+xml"},
+			{Href: c.BaseURL() + "/", Rel: "alternate"},
+		},
+	}
+	for _, blog := range posts {
+		entry := atomEntry{
+			Title:     blog.Title,
+			ID:        "urn:uuid:" + blog.Id,
+			Link:      atomLink{Href: c.BaseURL() + "/blog/" + blog.Slug, Rel: "alternate"},
+			Published: blog.PublishedAt.UTC().Format(time.RFC3339),
+			Updated:   blog.UpdatedAt.UTC().Format(time.RFC3339),
+			Author:    atomPerson{Name: blog.Author},
+			Content:   atomContent{Type: "html", Value: blog.ContentHTML},
+		}
+		for _, tag := range blog.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+// sendFeed writes the feed with an ETag over its bytes and a Last-Modified of
+// the newest change, and answers 304 when the reader already has it
+func sendFeed(c *fiber.Ctx, format, title string, filter func(Blog) bool) error {
+	mutex.Lock()
+	posts, updated := feedPosts(filter)
+	mutex.Unlock()
+
+	var feed interface{}
+	contentType := "application/rss+xml; charset=utf-8"
+	if format == "atom" {
+		feed = buildAtom(c, title, posts, updated)
+		contentType = "application/atom+xml; charset=utf-8"
+	} else {
+		feed = buildRSS(c, title, posts, updated)
+	}
+
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not build feed"})
+	}
+	body = append([]byte(xml.Header), body...)
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Set(fiber.HeaderETag, etag)
+	if !updated.IsZero() {
+		c.Set(fiber.HeaderLastModified, updated.UTC().Format(http.TimeFormat))
+	}
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	if notModified(c, etag, updated) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Send(body)
+}
+
+// notModified tells whether the reader's copy is current. If-None-Match wins
+// when both are sent, If-Modified-Since is compared with the newest post at
+// the second resolution of the header. c.Fresh() gets both cases wrong.
+func notModified(c *fiber.Ctx, etag string, updated time.Time) bool {
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		for _, tag := range strings.Split(noneMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	if err != nil || updated.IsZero() {
+		return false
+	}
+	return !updated.Truncate(time.Second).After(since)
+}
+
+func RSSFeed(c *fiber.Ctx) error {
+	return sendFeed(c, "rss", feedTitle, func(Blog) bool { return true })
+}
+
+func AtomFeed(c *fiber.Ctx) error {
+	return sendFeed(c, "atom", feedTitle, func(Blog) bool { return true })
+}
+
+func authorFeed(c *fiber.Ctx, format string) error {
+	author := c.Params("author")
+	return sendFeed(c, format, feedTitle+": posts by "+author, func(blog Blog) bool { return isAuthor(author, blog) })
+}
+
+func tagFeed(c *fiber.Ctx, format string) error {
+	tag := c.Params("tag")
+	return sendFeed(c, format, feedTitle+": posts tagged "+tag, func(blog Blog) bool { return hasTag(blog, tag) })
+}
+
+func AuthorRSSFeed(c *fiber.Ctx) error  { return authorFeed(c, "rss") }
+func AuthorAtomFeed(c *fiber.Ctx) error { return authorFeed(c, "atom") }
+func TagRSSFeed(c *fiber.Ctx) error     { return tagFeed(c, "rss") }
+func TagAtomFeed(c *fiber.Ctx) error    { return tagFeed(c, "atom") }
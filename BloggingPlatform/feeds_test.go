@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func getFeed(t *testing.T, app *fiber.App, header map[string]string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/feed.rss", nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestFeedConditionalGet(t *testing.T) {
+	testApp(t) // fresh data
+	app := fiber.New()
+	app.Get("/feed.rss", RSSFeed)
+	blog := publishedBlog(t)
+
+	first := getFeed(t, app, nil)
+	lastModified, etag := first.Header.Get(fiber.HeaderLastModified), first.Header.Get(fiber.HeaderETag)
+	if want := blog.PublishedAt.UTC().Format(http.TimeFormat); lastModified != want {
+		t.Fatalf("Last-Modified is %q, want the newest post %q", lastModified, want)
+	}
+
+	cases := []struct {
+		name   string
+		header map[string]string
+	}{
+		{"If-Modified-Since", map[string]string{fiber.HeaderIfModifiedSince: lastModified}},
+		{"If-None-Match", map[string]string{fiber.HeaderIfNoneMatch: etag}},
+		{"both", map[string]string{fiber.HeaderIfModifiedSince: lastModified, fiber.HeaderIfNoneMatch: etag}},
+	}
+	for _, tc := range cases {
+		if code := getFeed(t, app, tc.header).StatusCode; code != http.StatusNotModified {
+			t.Errorf("%s: got %d, want 304", tc.name, code)
+		}
+	}
+
+	// a newer post makes both validators stale
+	mutex.Lock()
+	newer := blog
+	newer.Id, newer.Slug = "newer", "newer"
+	newer.PublishedAt = blog.PublishedAt.Add(time.Minute)
+	newer.UpdatedAt = newer.PublishedAt
+	blogs[newer.Id] = newer
+	mutex.Unlock()
+	for _, tc := range cases {
+		if code := getFeed(t, app, tc.header).StatusCode; code != http.StatusOK {
+			t.Errorf("%s after a new post: got %d, want 200", tc.name, code)
+		}
+	}
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	md "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/JohannesKaufmann/html-to-markdown/plugin"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/gosimple/slug"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	maxImportFiles    = 1000
+	maxImportFileSize = 2 << 20 // bytes per post once unzipped
+
+	// categoriesFile in a bundle holds the category tree, parents first
+	categoriesFile = "categories.yml"
+)
+
+// FrontMatter is the YAML header of a post in a Markdown bundle. Export
+// writes these fields, import also understands the usual Jekyll and Hugo
+// spellings (categories, draft, dates without a time).
+type FrontMatter struct {
+	Title      string     `yaml:"title"`
+	Slug       string     `yaml:"slug,omitempty"`
+	Author     string     `yaml:"author,omitempty"`
+	CoAuthors  stringList `yaml:"coauthors,omitempty"`
+	Date       string     `yaml:"date,omitempty"` // publish date, or creation date for drafts
+	Updated    string     `yaml:"updated,omitempty"`
+	Status     string     `yaml:"status,omitempty"`
+	Draft      bool       `yaml:"draft,omitempty"`
+	Tags       stringList `yaml:"tags,omitempty"`
+	Category   string     `yaml:"category,omitempty"`
+	Categories stringList `yaml:"categories,omitempty"`
+}
+
+// stringList reads a YAML list or a comma separated string
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = nil
+		for _, item := range strings.Split(value.Value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*l = append(*l, item)
+			}
+		}
+		return nil
+	}
+	var items []string
+	if err := value.Decode(&items); err != nil {
+		return err
+	}
+	*l = items
+	return nil
+}
+
+// importedPost is a post read from any import format
+type importedPost struct {
+	Source    string // file name or WordPress post id, for the report
+	Title     string
+	Content   string // markdown
+	Slug      string
+	Author    string
+	CoAuthors []string
+	Date      time.Time
+	Updated   time.Time
+	Status    string
+	Tags      []string
+	Category  string // slug or name, see resolveCategory
+}
+
+type ImportedBlog struct {
+	Source string `json:"source"`
+	Id     string `json:"id"`
+	Title  string `json:"title"`
+	Slug   string `json:"slug"`
+	Status string `json:"status"`
+}
+
+type SkippedImport struct {
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+type ImportReport struct {
+	Imported []ImportedBlog  `json:"imported"`
+	Skipped  []SkippedImport `json:"skipped"`
+	Warnings []string        `json:"warnings"`
+
+	slugs map[string]bool // taken by this import, not by an earlier one
+}
+
+func newImportReport() *ImportReport {
+	return &ImportReport{Imported: []ImportedBlog{}, Skipped: []SkippedImport{}, Warnings: []string{}, slugs: make(map[string]bool)}
+}
+
+func (r *ImportReport) skip(source, reason string) {
+	r.Skipped = append(r.Skipped, SkippedImport{Source: source, Reason: reason})
+}
+
+// importDateLayouts are tried in order on dates from front matter and WXR
+var importDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+func parseImportDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range importDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// resolveCategory finds a category by slug or by name, creating a top level
+// one when there is none. Caller must hold the mutex.
+func resolveCategory(name string) string {
+	if _, exists := categories[name]; exists || name == "" {
+		return name
+	}
+	categorySlug := slug.Make(name)
+	if categorySlug == "" {
+		return ""
+	}
+	if _, exists := categories[categorySlug]; !exists {
+		categories[categorySlug] = Category{Slug: categorySlug, Name: name}
+	}
+	return categorySlug
+}
+
+// addImported stores one imported post. Posts keep their slug so old links
+// keep working, and a post whose slug an earlier import or another post took
+// is skipped, so importing the same file twice adds nothing. Authors that
+// have no account here fall back to the importing user. Caller must hold the
+// mutex.
+func addImported(c *fiber.Ctx, post importedPost, report *ImportReport) {
+	importer := currentUser(c)
+	if strings.TrimSpace(post.Title) == "" && strings.TrimSpace(post.Content) == "" {
+		report.skip(post.Source, "empty post")
+		return
+	}
+	if post.Slug = slug.Make(post.Slug); post.Slug == "" {
+		post.Slug = baseSlug(post.Title)
+	}
+	if _, taken := slugs[post.Slug]; taken && !report.slugs[post.Slug] {
+		report.skip(post.Source, "a post with slug "+post.Slug+" already exists")
+		return
+	}
+
+	html, err := renderMarkdown(post.Content)
+	if err != nil {
+		report.skip(post.Source, "could not render content")
+		return
+	}
+
+	now := time.Now()
+	blog := Blog{
+		Id:          uuid.New().String(),
+		Title:       post.Title,
+		Content:     post.Content,
+		ContentHTML: html,
+		Tags:        normalizeTags(post.Tags),
+		Category:    resolveCategory(post.Category),
+		Author:      post.Author,
+		CoAuthors:   []string{},
+		Date:        post.Date,
+		UpdatedAt:   post.Updated,
+		Status:      StatusDraft,
+	}
+	if _, exists := users[blog.Author]; !exists {
+		if blog.Author != "" {
+			report.Warnings = append(report.Warnings, post.Source+": author "+blog.Author+" has no account, assigned to "+importer)
+		}
+		blog.Author = importer
+	}
+	for _, coAuthor := range post.CoAuthors {
+		if _, exists := users[coAuthor]; exists && coAuthor != blog.Author {
+			blog.CoAuthors = append(blog.CoAuthors, coAuthor)
+		}
+	}
+	if blog.Date.IsZero() || (blog.Date.After(now) && post.Status != StatusScheduled) {
+		blog.Date = now
+	}
+	if blog.UpdatedAt.Before(blog.Date) {
+		blog.UpdatedAt = blog.Date
+	}
+
+	// the import itself is the editorial decision, so posts that were out
+	// on the old blog go out here too
+	switch post.Status {
+	case StatusPublished:
+		publish(&blog, blog.Date)
+	case StatusScheduled:
+		if post.Date.After(now) {
+			blog.Status = StatusScheduled
+			blog.PublishAt = &post.Date
+			blog.Date = now
+		} else {
+			publish(&blog, post.Date)
+		}
+	case StatusArchived:
+		blog.Status = StatusArchived
+		blog.PublishedAt = blog.Date
+	}
+
+	if blog.Status != StatusDraft {
+		blog.ApprovedAt = blog.UpdatedAt
+	}
+
+	blog.Slug = uniqueSlug(post.Slug, blog.Id)
+	slugs[blog.Slug] = blog.Id
+	report.slugs[post.Slug] = true
+	blogs[blog.Id] = blog
+	recordRevision(blog, importer, 0)
+
+	report.Imported = append(report.Imported, ImportedBlog{Source: post.Source, Id: blog.Id, Title: blog.Title, Slug: blog.Slug, Status: blog.Status})
+}
+
+// readUpload returns the multipart "file" field, editors only. When there is
+// nothing to import it answers the request and returns nil.
+func readUpload(c *fiber.Ctx) ([]byte, error) {
+	mutex.Lock()
+	editor := isEditor(currentUser(c))
+	mutex.Unlock()
+	if !editor {
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors can import posts"})
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file is required"})
+	}
+	f, err := header.Open()
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot read file"})
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot read file"})
+	}
+	return data, nil
+}
+
+// splitFrontMatter separates a leading YAML block between --- lines from
+// the markdown after it
+func splitFrontMatter(text string) (string, string) {
+	text = strings.TrimPrefix(strings.ReplaceAll(text, "\r\n", "\n"), "\ufeff")
+	if !strings.HasPrefix(text, "---\n") {
+		return "", text
+	}
+	lines := strings.SplitAfter(text, "\n")
+	for i := 1; i < len(lines); i++ {
+		if line := strings.TrimRight(lines[i], " \n"); line == "---" || line == "..." {
+			return strings.Join(lines[1:i], ""), strings.Join(lines[i+1:], "")
+		}
+	}
+	return "", text
+}
+
+var (
+	firstHeading = regexp.MustCompile(`(?m)^#\s+(.+?)\s*#*\s*$`)
+	jekyllDate   = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}-`)
+)
+
+// parseMarkdownPost reads one file of a Markdown bundle
+func parseMarkdownPost(name, text string) (importedPost, error) {
+	front, body := splitFrontMatter(text)
+	var fm FrontMatter
+	if err := yaml.Unmarshal([]byte(front), &fm); err != nil {
+		return importedPost{}, err
+	}
+
+	post := importedPost{
+		Source:    name,
+		Title:     fm.Title,
+		Content:   strings.TrimLeft(body, "\n"),
+		Slug:      fm.Slug,
+		Author:    fm.Author,
+		CoAuthors: fm.CoAuthors,
+		Tags:      fm.Tags,
+		Category:  fm.Category,
+		Status:    StatusPublished,
+	}
+	if post.Category == "" && len(fm.Categories) > 0 {
+		post.Category = fm.Categories[0] // nested ones only by slug, a bundle carries no tree
+	}
+	base := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	if post.Slug == "" {
+		post.Slug = jekyllDate.ReplaceAllString(base, "") // the file name is the slug for Jekyll and Hugo
+	}
+	if post.Title == "" {
+		// without a title the first heading is one, or else the file name
+		if m := firstHeading.FindStringSubmatchIndex(post.Content); m != nil {
+			post.Title = post.Content[m[2]:m[3]]
+			post.Content = strings.TrimLeft(post.Content[:m[0]]+post.Content[m[1]:], "\n")
+		} else {
+			post.Title = base
+		}
+	}
+	post.Date, _ = parseImportDate(fm.Date)
+	post.Updated, _ = parseImportDate(fm.Updated)
+
+	switch strings.ToLower(fm.Status) {
+	case "", "published", "publish":
+		if fm.Draft {
+			post.Status = StatusDraft
+		}
+	case "scheduled", "future":
+		post.Status = StatusScheduled
+	case "archived":
+		post.Status = StatusArchived
+	default: // draft, in_review, pending, private and whatever else
+		post.Status = StatusDraft
+	}
+	return post, nil
+}
+
+// ImportMarkdown reads a zip of Markdown files with YAML front matter, the
+// same layout ExportMarkdown writes
+func ImportMarkdown(c *fiber.Ctx) error {
+	data, err := readUpload(c)
+	if data == nil {
+		return err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file is not a zip archive"})
+	}
+
+	var posts []importedPost
+	var tree []Category
+	report := newImportReport()
+	for _, file := range archive.File {
+		name := file.Name
+		if file.FileInfo().IsDir() || strings.HasPrefix(path.Base(name), ".") || strings.HasPrefix(name, "__MACOSX/") {
+			continue
+		}
+		if name == categoriesFile {
+			if err := readZipYAML(file, &tree); err != nil {
+				report.skip(name, "invalid category list: "+err.Error())
+			}
+			continue
+		}
+		if ext := strings.ToLower(path.Ext(name)); ext != ".md" && ext != ".markdown" {
+			report.skip(name, "not a markdown file")
+			continue
+		}
+		if len(posts) == maxImportFiles {
+			report.skip(name, "too many files in one import")
+			continue
+		}
+		if file.UncompressedSize64 > maxImportFileSize {
+			report.skip(name, "file is too large")
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			report.skip(name, "cannot read file")
+			continue
+		}
+		text, err := io.ReadAll(io.LimitReader(r, maxImportFileSize))
+		r.Close()
+		if err != nil {
+			report.skip(name, "cannot read file")
+			continue
+		}
+		post, err := parseMarkdownPost(name, string(text))
+		if err != nil {
+			report.skip(name, "invalid front matter: "+err.Error())
+			continue
+		}
+		posts = append(posts, post)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	addCategories(tree, report)
+	for _, post := range posts {
+		addImported(c, post, report)
+	}
+	return c.JSON(report)
+}
+
+func readZipYAML(file *zip.File, out interface{}) error {
+	r, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return yaml.NewDecoder(io.LimitReader(r, maxImportFileSize)).Decode(out)
+}
+
+// addCategories creates the categories of an import that don't exist yet.
+// Parents have to come first, a category whose parent is unknown goes to the
+// top level with a warning. Caller must hold the mutex.
+func addCategories(tree []Category, report *ImportReport) {
+	for _, category := range tree {
+		if category.Slug = slug.Make(category.Slug); category.Slug == "" {
+			continue
+		}
+		if _, exists := categories[category.Slug]; exists {
+			continue
+		}
+		if parent := category.Parent; parent != "" {
+			category.Parent = slug.Make(parent)
+			if _, exists := categories[category.Parent]; !exists {
+				report.Warnings = append(report.Warnings, "category "+category.Slug+": parent "+parent+" not found, added at the top level")
+				category.Parent = ""
+			}
+		}
+		if category.Name == "" {
+			category.Name = category.Slug
+		}
+		categories[category.Slug] = category
+	}
+}
+
+// categoryTree lists every category with parents before their children.
+// Caller must hold the mutex.
+func categoryTree() []Category {
+	var tree []Category
+	var walk func(parent string)
+	walk = func(parent string) {
+		var children []Category
+		for _, category := range categories {
+			if category.Parent == parent {
+				children = append(children, category)
+			}
+		}
+		sort.Slice(children, func(i, j int) bool { return children[i].Slug < children[j].Slug })
+		for _, child := range children {
+			tree = append(tree, child)
+			walk(child.Slug)
+		}
+	}
+	walk("")
+	return tree
+}
+
+// wxr is the part of a WordPress export this importer reads. Element names
+// are matched without namespace since the wp namespace has a version in it.
+type wxr struct {
+	Channel struct {
+		Categories []struct {
+			Slug   string `xml:"category_nicename"`
+			Parent string `xml:"category_parent"`
+			Name   string `xml:"cat_name"`
+		} `xml:"category"`
+		Items []wxrItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type wxrItem struct {
+	Title    string `xml:"title"`
+	Creator  string `xml:"creator"`
+	Content  string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID   string `xml:"post_id"`
+	PostDate string `xml:"post_date"`
+	DateGMT  string `xml:"post_date_gmt"`
+	Modified string `xml:"post_modified_gmt"`
+	PostName string `xml:"post_name"`
+	Status   string `xml:"status"`
+	PostType string `xml:"post_type"`
+	Taxonomy []struct {
+		Domain   string `xml:"domain,attr"`
+		Nicename string `xml:"nicename,attr"`
+		Name     string `xml:",chardata"`
+	} `xml:"category"`
+}
+
+// autop wraps the blank line separated blocks of classic WordPress content
+// in paragraphs, WordPress itself only does that when it renders a post
+func autop(content string) string {
+	if strings.Contains(content, "<p") || strings.Contains(content, "<!-- wp:") {
+		return content
+	}
+	var b strings.Builder
+	for _, block := range regexp.MustCompile(`\n\s*\n`).Split(strings.ReplaceAll(content, "\r\n", "\n"), -1) {
+		if block = strings.TrimSpace(block); block != "" {
+			b.WriteString("<p>" + strings.ReplaceAll(block, "\n", "<br>\n") + "</p>\n")
+		}
+	}
+	return b.String()
+}
+
+// ImportWordPress reads a WordPress WXR export. Posts keep their author,
+// dates, slug, tags and first category, the category tree comes along. Pages,
+// attachments and trashed posts are left out.
+func ImportWordPress(c *fiber.Ctx) error {
+	data, err := readUpload(c)
+	if data == nil {
+		return err
+	}
+	var export wxr
+	if err := xml.Unmarshal(data, &export); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file is not a WordPress export: " + err.Error()})
+	}
+
+	converter := md.NewConverter("", true, nil)
+	converter.Use(plugin.GitHubFlavored())
+
+	report := newImportReport()
+	var posts []importedPost
+	for _, item := range export.Channel.Items {
+		source := "post " + item.PostID
+		if item.PostType != "post" {
+			if item.PostType != "attachment" && item.PostType != "nav_menu_item" {
+				report.skip(source, "not a post ("+item.PostType+")")
+			}
+			continue
+		}
+		if len(posts) == maxImportFiles {
+			report.skip(source, "too many posts in one import")
+			continue
+		}
+
+		content, err := converter.ConvertString(autop(item.Content))
+		if err != nil {
+			report.skip(source, "cannot convert content")
+			continue
+		}
+		post := importedPost{Source: source, Title: item.Title, Content: content, Slug: item.PostName, Author: item.Creator}
+		if date, ok := parseImportDate(item.DateGMT); ok && !strings.HasPrefix(item.DateGMT, "0000") {
+			post.Date = date
+		} else {
+			post.Date, _ = parseImportDate(item.PostDate) // drafts have no GMT date, site time is close enough
+		}
+		post.Updated, _ = parseImportDate(item.Modified)
+
+		switch item.Status {
+		case "publish":
+			post.Status = StatusPublished
+		case "future":
+			post.Status = StatusScheduled
+		case "trash":
+			report.skip(source, "trashed")
+			continue
+		default: // draft, pending, private
+			post.Status = StatusDraft
+		}
+
+		for _, term := range item.Taxonomy {
+			switch term.Domain {
+			case "post_tag":
+				post.Tags = append(post.Tags, term.Name)
+			case "category":
+				if post.Category == "" && term.Nicename != "uncategorized" {
+					post.Category = term.Nicename
+				}
+			}
+		}
+		posts = append(posts, post)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// WordPress lists parents before their children too
+	var tree []Category
+	for _, category := range export.Channel.Categories {
+		if category.Slug != "uncategorized" {
+			tree = append(tree, Category{Slug: category.Slug, Name: category.Name, Parent: category.Parent})
+		}
+	}
+	addCategories(tree, report)
+	for _, post := range posts {
+		addImported(c, post, report)
+	}
+	return c.JSON(report)
+}
+
+// exportDate is the date a post is listed under, when it went out or else
+// when it was written
+func exportDate(blog Blog) time.Time {
+	if !blog.PublishedAt.IsZero() {
+		return blog.PublishedAt
+	}
+	if blog.PublishAt != nil {
+		return *blog.PublishAt
+	}
+	return blog.Date
+}
+
+// ExportMarkdown sends a zip with one Markdown file per post, named after
+// its slug, with the metadata in YAML front matter, and the category tree in
+// categories.yml. Editors get every post, everyone else the posts they wrote
+// or co-wrote.
+func ExportMarkdown(c *fiber.Ctx) error {
+	username := currentUser(c)
+
+	mutex.Lock()
+	var posts []Blog
+	for _, blog := range blogs {
+		if isAuthor(username, blog) || isEditor(username) {
+			posts = append(posts, blog)
+		}
+	}
+	tree := categoryTree()
+	mutex.Unlock()
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Slug < posts[j].Slug })
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	if len(tree) > 0 {
+		w, err := archive.Create(categoriesFile)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not build export"})
+		}
+		if err := yaml.NewEncoder(w).Encode(tree); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not build export"})
+		}
+	}
+	for _, blog := range posts {
+		status := blog.Status
+		if status != StatusPublished && status != StatusScheduled && status != StatusArchived {
+			status = StatusDraft // review states don't carry over
+		}
+		fm := FrontMatter{
+			Title:     blog.Title,
+			Slug:      blog.Slug,
+			Author:    blog.Author,
+			CoAuthors: blog.CoAuthors,
+			Date:      exportDate(blog).UTC().Format(time.RFC3339),
+			Updated:   blog.UpdatedAt.UTC().Format(time.RFC3339),
+			Status:    status,
+			Tags:      blog.Tags,
+			Category:  blog.Category,
+		}
+		front, err := yaml.Marshal(fm)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not export " + blog.Slug})
+		}
+
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: blog.Slug + ".md", Method: zip.Deflate, Modified: blog.UpdatedAt})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not build export"})
+		}
+		w.Write([]byte("---\n"))
+		w.Write(front)
+		w.Write([]byte("---\n\n"))
+		w.Write([]byte(blog.Content))
+		if !strings.HasSuffix(blog.Content, "\n") {
+			w.Write([]byte("\n"))
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not build export"})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="blog-export-`+time.Now().UTC().Format(dayFormat)+`.zip"`)
+	return c.Send(buf.Bytes())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// BlogQuery holds the filters, search and paging of a listing, read from
+// ?author=&tag=&category=&from=&to=&q=&sort=&page=&per_page=
+type BlogQuery struct {
+	Author   string
+	Tag      string
+	Category string // includes subcategories
+	From     time.Time
+	To       time.Time
+	Terms    []string // every term has to appear in the title or content
+	Oldest   bool     // sort oldest first instead of newest first
+	Page     int
+	PerPage  int
+}
+
+// BlogPage is one page of a listing, Total counts every match
+type BlogPage struct {
+	Blogs   []Blog `json:"blogs"`
+	Total   int    `json:"total"`
+	Page    int    `json:"page"`
+	PerPage int    `json:"per_page"`
+}
+
+// parseListDate reads a date range bound, a plain date as the start of
+// that day (UTC) or a full RFC 3339 time
+func parseListDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func parseBlogQuery(c *fiber.Ctx) (BlogQuery, error) {
+	query := BlogQuery{
+		Author:   c.Query("author"),
+		Tag:      c.Query("tag"),
+		Category: c.Query("category"),
+		Terms:    strings.Fields(strings.ToLower(c.Query("q"))),
+		Page:     1,
+		PerPage:  defaultPerPage,
+	}
+	if query.Tag != "" {
+		if tags := normalizeTags([]string{query.Tag}); len(tags) > 0 {
+			query.Tag = tags[0]
+		}
+	}
+
+	var err error
+	if from := c.Query("from"); from != "" {
+		if query.From, err = parseListDate(from); err != nil {
+			return query, errors.New("from must be a date like 2024-01-31")
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = parseListDate(to); err != nil {
+			return query, errors.New("to must be a date like 2024-01-31")
+		}
+		if !strings.Contains(to, "T") {
+			query.To = query.To.AddDate(0, 0, 1) // a plain date includes the whole day
+		}
+	}
+
+	switch c.Query("sort", "newest") {
+	case "newest":
+	case "oldest":
+		query.Oldest = true
+	default:
+		return query, errors.New("sort must be newest or oldest")
+	}
+
+	if page := c.Query("page"); page != "" {
+		if query.Page, err = strconv.Atoi(page); err != nil || query.Page < 1 {
+			return query, errors.New("page must be a positive number")
+		}
+	}
+	if perPage := c.Query("per_page"); perPage != "" {
+		if query.PerPage, err = strconv.Atoi(perPage); err != nil || query.PerPage < 1 || query.PerPage > maxPerPage {
+			return query, errors.New("per_page must be between 1 and " + strconv.Itoa(maxPerPage))
+		}
+	}
+	return query, nil
+}
+
+func (q BlogQuery) matches(blog Blog) bool {
+	if q.Author != "" && !isAuthor(q.Author, blog) {
+		return false
+	}
+	if q.Tag != "" && !hasTag(blog, q.Tag) {
+		return false
+	}
+	if q.Category != "" && !inCategory(blog.Category, q.Category) {
+		return false
+	}
+	if !q.From.IsZero() && blog.PublishedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !blog.PublishedAt.Before(q.To) {
+		return false
+	}
+	if len(q.Terms) > 0 {
+		text := strings.ToLower(blog.Title + "\n" + blog.Content)
+		for _, term := range q.Terms {
+			if !strings.Contains(text, term) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// run filters, sorts by publish date and pages the published posts. Caller
+// must hold the mutex.
+func (q BlogQuery) run() BlogPage {
+	var matched []Blog
+	for _, blog := range blogs {
+		if blog.Status == StatusPublished && q.matches(blog) {
+			matched = append(matched, blog)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if q.Oldest {
+			a, b = b, a
+		}
+		if !a.PublishedAt.Equal(b.PublishedAt) {
+			return a.PublishedAt.After(b.PublishedAt)
+		}
+		return a.Id > b.Id
+	})
+
+	page := BlogPage{Blogs: []Blog{}, Total: len(matched), Page: q.Page, PerPage: q.PerPage}
+	start := (q.Page - 1) * q.PerPage
+	if start < len(matched) {
+		end := start + q.PerPage
+		if end > len(matched) {
+			end = len(matched)
+		}
+		page.Blogs = matched[start:end]
+	}
+	return page
+}
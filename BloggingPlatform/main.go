@@ -10,16 +10,75 @@ import (
 )
 
 func main() {
-	router := fiber.New()
+	// Immutable because params end up stored in blogs
+	router := fiber.New(fiber.Config{
+		Immutable: true,
+		BodyLimit: maxUploadSize + 1<<20, // room for the multipart framing
+	})
+
+	go runPublisher()
+	go runAnalytics()
 
 	router.Post("/create", register)
 	router.Post("/login", login)
+	router.Get("/blogs/highlight.css", HighlightCSS)
+
+	// Public routes for readers, a token is only used to show drafts to their author
+	router.Get("/feed.rss", RSSFeed)
+	router.Get("/feed.atom", AtomFeed)
+	router.Get("/author/:author/feed.rss", AuthorRSSFeed)
+	router.Get("/author/:author/feed.atom", AuthorAtomFeed)
+	router.Get("/tag/:tag/feed.rss", TagRSSFeed)
+	router.Get("/tag/:tag/feed.atom", TagAtomFeed)
+	router.Get("/blog/:slug", optionalJWT, ViewBlogBySlug)
+	router.Get("/media/:id/:variant", ServeMedia)
+
 	router.Use(jwtMiddleware) // Apply JWT middleware for all routes below
 	router.Post("/blogs/create", CreateBlogs)
+	router.Post("/blogs/preview", PreviewBlog)
 	router.Get("/blogs/view", GetAllBlogs)
 	router.Get("/blog/view/:id", ViewBlog)       // Added :id parameter
 	router.Post("/blog/delete/:id", DeleteBlogs) // Added :id parameter
 	router.Post("/blog/update/:id", UpdateBlogs) // Added :id parameter
+	router.Post("/blog/publish/:id", PublishBlog)
+	router.Post("/blog/unpublish/:id", UnpublishBlog)
+	router.Post("/blog/archive/:id", ArchiveBlog)
+	router.Get("/blogs/drafts", MyDrafts)
+	router.Post("/blog/submit/:id", SubmitForReview)
+	router.Post("/blog/approve/:id", ApproveBlog)
+	router.Post("/blog/request-changes/:id", RequestChanges) // summary and line notes
+	router.Get("/blog/reviews/:id", GetReviews)
+	router.Post("/blog/reviews/:id/resolve/:note", ResolveNote)
+	router.Get("/reviews/queue", ReviewQueue)
+	router.Post("/blog/coauthors/:id", SetCoAuthors)
+	router.Post("/users/role/:username", SetRole)
+	router.Get("/analytics", GetDashboard)            // ?from=&to=&top=&author=
+	router.Post("/import/wordpress", ImportWordPress) // multipart, field "file"
+	router.Post("/import/markdown", ImportMarkdown)   // zip of .md files with front matter
+	router.Get("/export", ExportMarkdown)
+	router.Get("/blog/revisions/:id", GetRevisions)
+	router.Get("/blog/revisions/:id/:rev", GetRevision)
+	router.Get("/blog/diff/:id", DiffRevisions) // ?from=&to= revision numbers
+	router.Post("/blog/restore/:id/:rev", RestoreRevision)
+	router.Post("/media/upload", UploadMedia) // multipart, field "file"
+	router.Get("/media", MyMedia)
+	router.Post("/media/delete/:id", DeleteMedia)
+	router.Get("/tags", GetTags)
+	router.Get("/categories", GetCategories)
+	router.Post("/categories/create", CreateCategory)
+	router.Post("/category/delete/:slug", DeleteCategory)
+
+	router.Post("/blog/comments/:id", CreateComment) // :id is the blog
+	router.Get("/blog/comments/:id", GetComments)
+	router.Post("/blog/lock/:id", LockComments)
+	router.Post("/blog/unlock/:id", UnlockComments)
+	router.Post("/comment/update/:id", UpdateComment)
+	router.Post("/comment/delete/:id", DeleteComment)
+	router.Post("/comment/approve/:id", ApproveComment)
+	router.Post("/comment/reject/:id", RejectComment)
+	router.Get("/comments/queue", ModerationQueue)
+	router.Get("/comments/blocklist", GetBlocklist)
+	router.Post("/comments/blocklist", SetBlocklist)
 
 	log.Fatal(router.Listen(":3000"))
 
@@ -28,14 +87,40 @@ func main() {
 type User struct {
 	UserName string `json:"user_name"`
 	Password string `json:"password"`
+	Type     string `json:"type"` // role: writer, editor or admin, see review.go
 }
 
 type Blog struct {
-	Id      string `json:"id"`
-	Title   string `json:"title"`
-	Content string `json:"content"`
-	Author  string `json:"author"`
-	Date    string `json:"date"`
+	Id          string    `json:"id"`
+	Title       string    `json:"title"`
+	Content     string    `json:"content"`      // markdown source
+	ContentHTML string    `json:"content_html"` // sanitized rendering of Content, see markdown.go
+	Slug        string    `json:"slug"`         // permalink at /blog/:slug, see slugs.go
+	Tags        []string  `json:"tags"`
+	Category    string    `json:"category,omitempty"` // slug of a category, see categories.go
+	Author      string    `json:"author"`             // taken from the token, never from the body
+	CoAuthors   []string  `json:"coauthors"`          // may edit the post too, see review.go
+	Date        time.Time `json:"date"`               // set by the server when the post is created
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	Status      string     `json:"status"`               // see publishing.go
+	PublishAt   *time.Time `json:"publish_at,omitempty"` // when a scheduled post goes out
+	PublishedAt time.Time  `json:"published_at"`         // first time the post went public
+	ApprovedAt  time.Time  `json:"approved_at"`          // last time an editor signed off on the text
+
+	CommentsLocked bool `json:"comments_locked"` // no new comments or edits, see comments.go
+}
+
+// BlogRequest is what clients may send when writing a post, author and
+// dates in the body are ignored
+type BlogRequest struct {
+	Title    string   `json:"title"`
+	Content  string   `json:"content"`
+	Tags     []string `json:"tags"`
+	Category string   `json:"category"`
+
+	// only read on create, afterwards use the review and publish endpoints
+	Status string `json:"status"` // draft (default) or in_review
 }
 
 var (
@@ -71,6 +156,43 @@ func jwtMiddleware(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// optionalJWT identifies the caller when a valid token is sent and lets
+// anonymous readers through otherwise
+func optionalJWT(c *fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+	if len(authHeader) <= len("Bearer ") {
+		return c.Next()
+	}
+
+	token, err := jwt.Parse(authHeader[len("Bearer "):], func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err == nil && token.Valid {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			c.Locals("username", claims["username"])
+			c.Locals("type", claims["type"])
+		}
+	}
+	return c.Next()
+}
+
+func currentUser(c *fiber.Ctx) string {
+	username, _ := c.Locals("username").(string)
+	return username
+}
+
+// canModify tells whether the caller may edit blog. The role is read from
+// the stored user so a changed role applies to old tokens too. Caller must
+// hold the mutex.
+func canModify(username string, blog Blog) bool {
+	return isAuthor(username, blog) || isEditor(username)
+}
+
+// isEditor is true for editors and admins
+func isEditor(username string) bool {
+	return users[username].Type == RoleEditor || isAdmin(username)
+}
+
 func register(c *fiber.Ctx) error {
 	user := new(User)
 	if err := c.BodyParser(user); err != nil {
@@ -83,6 +205,12 @@ func register(c *fiber.Ctx) error {
 	if _, exists := users[user.UserName]; exists {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "user already exists"})
 	}
+	// the role is never taken from the body. The first user runs the
+	// platform, everyone else starts as a writer until promoted, see SetRole.
+	user.Type = RoleWriter
+	if len(users) == 0 {
+		user.Type = RoleAdmin
+	}
 
 	users[user.UserName] = *user
 	return c.Status(fiber.StatusCreated).JSON(user)
@@ -105,6 +233,7 @@ func login(c *fiber.Ctx) error {
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := token.Claims.(jwt.MapClaims)
 	claims["username"] = user.UserName
+	claims["type"] = storedUser.Type
 	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
 
 	t, err := token.SignedString(jwtSecret)
@@ -117,16 +246,46 @@ func login(c *fiber.Ctx) error {
 }
 
 func CreateBlogs(c *fiber.Ctx) error {
-	blog := new(Blog)
-	if err := c.BodyParser(blog); err != nil {
+	req := new(BlogRequest)
+	if err := c.BodyParser(req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
 	}
 
+	html, err := renderMarkdown(req.Content)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not render content"})
+	}
+
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	blog.Id = uuid.New().String()
+	if _, exists := categories[req.Category]; req.Category != "" && !exists {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "category not found"})
+	}
+
+	blog := &Blog{
+		Id:          uuid.New().String(),
+		Title:       req.Title,
+		Content:     req.Content,
+		ContentHTML: html,
+		Tags:        normalizeTags(req.Tags),
+		Category:    req.Category,
+		Author:      currentUser(c),
+		CoAuthors:   []string{},
+		Date:        time.Now(),
+		Status:      StatusDraft,
+	}
+	blog.UpdatedAt = blog.Date
+	switch req.Status {
+	case "", StatusDraft:
+	case StatusInReview:
+		blog.Status = StatusInReview
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "status must be draft or in_review, posts are published once approved"})
+	}
+	assignSlug(blog)
 	blogs[blog.Id] = *blog
+	recordRevision(*blog, blog.Author, 0)
 
 	return c.Status(fiber.StatusCreated).JSON(blog)
 
@@ -134,36 +293,55 @@ func CreateBlogs(c *fiber.Ctx) error {
 
 func UpdateBlogs(c *fiber.Ctx) error {
 	blogID := c.Params("id")
-	blog := new(Blog)
-	if err := c.BodyParser(blog); err != nil {
+	req := new(BlogRequest)
+	if err := c.BodyParser(req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
 	}
+	html, err := renderMarkdown(req.Content)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not render content"})
+	}
 
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	_, exists := blogs[blogID]
+	storedBlog, exists := blogs[blogID]
 	if !exists {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
 	}
+	if !canModify(currentUser(c), storedBlog) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author or an editor can change this blog"})
+	}
+	if _, exists := categories[req.Category]; req.Category != "" && !exists {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "category not found"})
+	}
 
-	blog.Id = blogID
-	blogs[blogID] = *blog
+	blog := storedBlog
+	blog.Title = req.Title
+	blog.Content = req.Content
+	blog.ContentHTML = html
+	blog.Tags = normalizeTags(req.Tags)
+	blog.Category = req.Category
+	blog.UpdatedAt = time.Now()
+	invalidateApproval(currentUser(c), &blog)
+	assignSlug(&blog)
+	blogs[blogID] = blog
+	recordRevision(blog, currentUser(c), 0)
 
 	return c.JSON(blog)
 }
 
+// GetAllBlogs lists published posts, see listing.go for the query parameters
 func GetAllBlogs(c *fiber.Ctx) error {
+	query, err := parseBlogQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	var result []Blog
-
-	for _, value := range blogs {
-		result = append(result, value)
-	}
-
-	return c.JSON(result)
+	return c.JSON(query.run())
 }
 
 func DeleteBlogs(c *fiber.Ctx) error {
@@ -173,12 +351,24 @@ func DeleteBlogs(c *fiber.Ctx) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	_, exists := blogs[blogID]
+	blog, exists := blogs[blogID]
 	if !exists {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
 	}
+	if username := currentUser(c); blog.Author != username && !isEditor(username) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author or an editor can delete this blog"})
+	}
 
 	delete(blogs, blogID)
+	removeSlugs(blogID)
+	delete(revisions, blogID)
+	delete(reviews, blogID)
+	forgetStats(blogID)
+	for id, comment := range comments {
+		if comment.BlogId == blogID {
+			delete(comments, id)
+		}
+	}
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
@@ -188,10 +378,20 @@ func ViewBlog(c *fiber.Ctx) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	_, exists := blogs[blogID]
-	if !exists {
+	blog, exists := blogs[blogID]
+	if !exists || !isVisible(currentUser(c), blog) {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
 	}
 
-	return c.JSON(blogs[blogID])
+	recordView(c, blog)
+	return sendBlog(c, blog)
+}
+
+// sendBlog answers with the blog as JSON, ?format=markdown or ?format=html
+// serve just one form of the content
+func sendBlog(c *fiber.Ctx, blog Blog) error {
+	if format := c.Query("format", "json"); format != "json" {
+		return sendBlogContent(c, blog, format)
+	}
+	return c.JSON(blog)
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gofiber/fiber/v2"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+)
+
+// highlightStyle is the chroma style served at /blogs/highlight.css. Code
+// blocks only carry class names, so changing the look needs no re-render.
+const highlightStyle = "github"
+
+// markdown renders CommonMark with the GitHub extensions (tables, fenced
+// code, strikethrough, autolinks, task lists). Raw HTML in the source is
+// dropped, goldmark only passes it through with html.WithUnsafe.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.GFM,
+		highlighting.NewHighlighting(
+			highlighting.WithStyle(highlightStyle),
+			highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+		),
+	),
+)
+
+// htmlPolicy is the last line of defense against XSS: user generated content
+// rules plus the classes chroma puts on code and the task list checkboxes
+var htmlPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9_\- ]+$`)).OnElements("pre", "code", "span")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	p.AllowAttrs("style").Matching(regexp.MustCompile(`^text-align:\s*(left|right|center);?$`)).OnElements("th", "td")
+	return p
+}()
+
+// renderMarkdown turns a post's source into sanitized HTML
+func renderMarkdown(source string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return htmlPolicy.Sanitize(buf.String()), nil
+}
+
+// PreviewBlog renders markdown the way a saved post would be, without saving
+func PreviewBlog(c *fiber.Ctx) error {
+	req := new(BlogRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	html, err := renderMarkdown(req.Content)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not render content"})
+	}
+
+	return c.JSON(fiber.Map{"title": req.Title, "content": req.Content, "content_html": html})
+}
+
+// sendBlogContent serves only the source or only the rendered form of a post
+func sendBlogContent(c *fiber.Ctx, blog Blog, format string) error {
+	switch format {
+	case "markdown":
+		c.Set(fiber.HeaderContentType, "text/markdown; charset=utf-8")
+		return c.SendString(blog.Content)
+	case "html":
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		c.Set("Content-Security-Policy", "default-src 'none'; img-src 'self' https: data:; style-src 'self'")
+		return c.SendString(blog.ContentHTML)
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "format must be json, markdown or html"})
+}
+
+// HighlightCSS serves the stylesheet for the classes in rendered code blocks
+func HighlightCSS(c *fiber.Ctx) error {
+	var buf bytes.Buffer
+	if err := chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(&buf, styles.Get(highlightStyle)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not build stylesheet"})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/css; charset=utf-8")
+	c.Set(fiber.HeaderCacheControl, "public, max-age=86400")
+	return c.Send(buf.Bytes())
+}
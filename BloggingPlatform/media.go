@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	_ "golang.org/x/image/webp" // imaging registers the other image formats
+)
+
+const (
+	maxUploadSize = 10 << 20   // bytes
+	maxPixels     = 50_000_000 // larger images are refused before decoding them
+)
+
+// mediaTypes are the accepted uploads by sniffed content type, with the
+// extension the original is stored under. SVG is left out on purpose, it can
+// carry scripts.
+var mediaTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"audio/mpeg":      ".mp3",
+	"application/pdf": ".pdf",
+}
+
+// imageVariants are the resized copies made of every image. The thumbnail is
+// cropped to a square, the others keep the aspect ratio and are only made
+// when the original is wider.
+var imageVariants = []struct {
+	Name   string
+	Width  int
+	Height int
+	Crop   bool
+}{
+	{"thumb", 200, 200, true},
+	{"medium", 800, 0, false},
+	{"large", 1600, 0, false},
+}
+
+// MediaFile is one stored file of an upload, the original or a variant
+type MediaFile struct {
+	Key         string `json:"-"` // in the storage
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+}
+
+type Media struct {
+	Id       string               `json:"id"`
+	Owner    string               `json:"owner"`
+	Filename string               `json:"filename"`
+	Date     time.Time            `json:"date"`
+	Files    map[string]MediaFile `json:"files"` // original, and for images thumb, medium and large
+	Embed    string               `json:"embed"` // markdown to paste into Blog.Content
+}
+
+var (
+	media = make(map[string]Media)
+	// files live under MEDIA_DIR, by default ./uploads
+	store Storage = NewLocalStorage(envOr("MEDIA_DIR", "uploads"))
+)
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// markdownLabel keeps a file name from closing the link text early
+var markdownLabel = strings.NewReplacer("[", "", "]", "", "\n", " ")
+
+func mediaURL(id, name string) string {
+	return "/media/" + id + "/" + name
+}
+
+// encodeVariant resizes img and encodes it as JPEG when the original was one,
+// as PNG otherwise to keep transparency
+func encodeVariant(img image.Image, width, height int, crop bool, contentType string) (MediaFile, []byte, error) {
+	var resized *image.NRGBA
+	if crop {
+		resized = imaging.Fill(img, width, height, imaging.Center, imaging.Lanczos)
+	} else {
+		resized = imaging.Resize(img, width, height, imaging.Lanczos)
+	}
+
+	var buf bytes.Buffer
+	file := MediaFile{Width: resized.Bounds().Dx(), Height: resized.Bounds().Dy()}
+	var err error
+	if contentType == "image/jpeg" {
+		file.ContentType = "image/jpeg"
+		err = imaging.Encode(&buf, resized, imaging.JPEG, imaging.JPEGQuality(85))
+	} else {
+		file.ContentType = "image/png"
+		err = imaging.Encode(&buf, resized, imaging.PNG)
+	}
+	file.Size = buf.Len()
+	return file, buf.Bytes(), err
+}
+
+// UploadMedia stores the multipart "file" field. The type is sniffed from the
+// bytes, not taken from the client, and images get resized variants.
+func UploadMedia(c *fiber.Ctx) error {
+	header, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file is required"})
+	}
+	if header.Size > maxUploadSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "files can be at most 10 MB"})
+	}
+	f, err := header.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot read file"})
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxUploadSize))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot read file"})
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	ext, allowed := mediaTypes[contentType]
+	if !allowed {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": "unsupported file type " + contentType})
+	}
+
+	item := Media{
+		Id:       uuid.New().String(),
+		Owner:    currentUser(c),
+		Filename: filepath.Base(header.Filename),
+		Date:     time.Now(),
+		Files:    make(map[string]MediaFile),
+	}
+	contents := make(map[string][]byte)
+	original := MediaFile{Key: item.Id + "/original" + ext, ContentType: contentType, Size: len(data)}
+	contents["original"] = data
+
+	if strings.HasPrefix(contentType, "image/") {
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot read image"})
+		}
+		if config.Width*config.Height > maxPixels {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "image has too many pixels"})
+		}
+		img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot read image"})
+		}
+		original.Width, original.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+		for _, variant := range imageVariants {
+			if !variant.Crop && original.Width <= variant.Width {
+				continue
+			}
+			file, encoded, err := encodeVariant(img, variant.Width, variant.Height, variant.Crop, contentType)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not resize image"})
+			}
+			file.Key = item.Id + "/" + variant.Name + mediaTypes[file.ContentType]
+			item.Files[variant.Name] = file
+			contents[variant.Name] = encoded
+		}
+	}
+	item.Files["original"] = original
+
+	for name, file := range item.Files {
+		if err := store.Put(file.Key, bytes.NewReader(contents[name])); err != nil {
+			deleteMediaFiles(item)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not store file"})
+		}
+		file.URL = mediaURL(item.Id, name)
+		item.Files[name] = file
+	}
+
+	// images embed the medium size when there is one, linking to the original
+	label := markdownLabel.Replace(item.Filename)
+	switch {
+	case item.Files["medium"].URL != "":
+		item.Embed = "[![" + label + "](" + item.Files["medium"].URL + ")](" + item.Files["original"].URL + ")"
+	case strings.HasPrefix(contentType, "image/"):
+		item.Embed = "![" + label + "](" + item.Files["original"].URL + ")"
+	default:
+		item.Embed = "[" + label + "](" + item.Files["original"].URL + ")"
+	}
+
+	mutex.Lock()
+	media[item.Id] = item
+	mutex.Unlock()
+
+	return c.Status(fiber.StatusCreated).JSON(item)
+}
+
+func deleteMediaFiles(item Media) {
+	for _, file := range item.Files {
+		store.Delete(file.Key)
+	}
+}
+
+// ServeMedia sends a stored file. Files never change once uploaded, so
+// they can be cached for good. Anyone with the link can fetch it, the same as
+// images embedded in a published post.
+func ServeMedia(c *fiber.Ctx) error {
+	mutex.Lock()
+	file, exists := media[c.Params("id")].Files[c.Params("variant")]
+	mutex.Unlock()
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "file not found"})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "public, max-age=31536000, immutable")
+	c.Set(fiber.HeaderETag, `"`+file.Key+`"`)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	if c.Fresh() {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	r, err := store.Open(file.Key)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "file not found"})
+	}
+	c.Set(fiber.HeaderContentType, file.ContentType)
+	return c.SendStream(r, file.Size) // fasthttp closes r once sent
+}
+
+// MyMedia lists the caller's uploads, newest first
+func MyMedia(c *fiber.Ctx) error {
+	username := currentUser(c)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	result := []Media{}
+	for _, item := range media {
+		if item.Owner == username {
+			result = append(result, item)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date.After(result[j].Date) })
+	return c.JSON(result)
+}
+
+// DeleteMedia removes an upload and its variants, posts that embed it will
+// show a broken link
+func DeleteMedia(c *fiber.Ctx) error {
+	mediaID := c.Params("id")
+
+	mutex.Lock()
+	item, exists := media[mediaID]
+	if !exists {
+		mutex.Unlock()
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "media not found"})
+	}
+	if item.Owner != currentUser(c) && !isEditor(currentUser(c)) {
+		mutex.Unlock()
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the owner or an editor can delete this file"})
+	}
+	delete(media, mediaID)
+	mutex.Unlock()
+
+	deleteMediaFiles(item)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// A post goes draft -> in_review -> approved -> scheduled or published, see
+// review.go for the review steps
+const (
+	StatusDraft            = "draft"
+	StatusInReview         = "in_review"
+	StatusChangesRequested = "changes_requested"
+	StatusApproved         = "approved"
+	StatusScheduled        = "scheduled"
+	StatusPublished        = "published"
+	StatusArchived         = "archived"
+)
+
+// how often the background publisher looks for scheduled posts that are due
+const publishInterval = 10 * time.Second
+
+type PublishRequest struct {
+	PublishAt *time.Time `json:"publish_at"` // empty publishes right away
+}
+
+// isVisible tells whether username may read blog. Only published posts are
+// public, the rest is seen by whoever can modify it. Caller must hold the mutex.
+func isVisible(username string, blog Blog) bool {
+	return blog.Status == StatusPublished || canModify(username, blog)
+}
+
+// publish makes blog public. PublishedAt is only set the first time so
+// re-publishing an archived post keeps its original date.
+func publish(blog *Blog, now time.Time) {
+	blog.Status = StatusPublished
+	blog.PublishAt = nil
+	if blog.PublishedAt.IsZero() {
+		blog.PublishedAt = now
+	}
+}
+
+// publishDue publishes every scheduled post whose time has come
+func publishDue(now time.Time) {
+	for id, blog := range blogs {
+		if blog.Status == StatusScheduled && blog.PublishAt != nil && !blog.PublishAt.After(now) {
+			publish(&blog, *blog.PublishAt)
+			blogs[id] = blog
+		}
+	}
+}
+
+func runPublisher() {
+	for range time.Tick(publishInterval) {
+		mutex.Lock()
+		publishDue(time.Now())
+		mutex.Unlock()
+	}
+}
+
+// isPublishable is true for posts an editor approved. Archived posts were
+// approved before they went out the first time, unless they changed since.
+func isPublishable(blog Blog) bool {
+	switch blog.Status {
+	case StatusApproved, StatusScheduled, StatusPublished:
+		return true
+	case StatusArchived:
+		return !blog.PublishedAt.IsZero() && !blog.UpdatedAt.After(blog.ApprovedAt)
+	}
+	return false
+}
+
+// PublishBlog publishes a post now, or schedules it when publish_at is in the future
+func PublishBlog(c *fiber.Ctx) error {
+	blogID := c.Params("id")
+	req := new(PublishRequest)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[blogID]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	if !canModify(currentUser(c), blog) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author or an editor can publish this blog"})
+	}
+	if !isPublishable(blog) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "blog has to be approved by an editor first"})
+	}
+
+	now := time.Now()
+	if req.PublishAt != nil && req.PublishAt.After(now) {
+		if blog.Status == StatusPublished {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "blog is already published, unpublish it first"})
+		}
+		blog.Status = StatusScheduled
+		blog.PublishAt = req.PublishAt
+	} else {
+		publish(&blog, now)
+	}
+	blogs[blogID] = blog
+
+	return c.JSON(blog)
+}
+
+func setStatus(c *fiber.Ctx, status string, from ...string) error {
+	blogID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[blogID]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	if !canModify(currentUser(c), blog) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author or an editor can change the status of this blog"})
+	}
+	allowed := false
+	for _, s := range from {
+		allowed = allowed || blog.Status == s
+	}
+	if !allowed {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "cannot move blog from " + blog.Status + " to " + status})
+	}
+
+	blog.Status = status
+	blog.PublishAt = nil
+	blogs[blogID] = blog
+	return c.JSON(blog)
+}
+
+// UnpublishBlog takes a published, scheduled or archived post back to draft,
+// it needs another review before it can go out again
+func UnpublishBlog(c *fiber.Ctx) error {
+	return setStatus(c, StatusDraft, StatusPublished, StatusScheduled, StatusArchived)
+}
+
+// ArchiveBlog hides a post from the listing without deleting it
+func ArchiveBlog(c *fiber.Ctx) error {
+	return setStatus(c, StatusArchived, StatusDraft, StatusScheduled, StatusPublished)
+}
+
+// MyDrafts lists the posts the caller writes or co-writes that are not out
+// yet, last edited first
+func MyDrafts(c *fiber.Ctx) error {
+	username := currentUser(c)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	result := []Blog{}
+	for _, blog := range blogs {
+		if isAuthor(username, blog) && blog.Status != StatusPublished && blog.Status != StatusArchived {
+			result = append(result, blog)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UpdatedAt.After(result[j].UpdatedAt) })
+
+	return c.JSON(result)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Roles, stored in User.Type and only ever set by the server. Editors review,
+// can change anyone's posts and promote writers, admins can hand out any role.
+const (
+	RoleWriter = "writer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+// ReviewNote is a remark of a reviewer, on one line of the post when Line is
+// set. Line and Quote refer to the revision that was reviewed.
+type ReviewNote struct {
+	Id       string `json:"id"`
+	Line     int    `json:"line,omitempty"`
+	Quote    string `json:"quote,omitempty"` // the text of the line when the note was written
+	Text     string `json:"text"`
+	Resolved bool   `json:"resolved"`
+}
+
+// Review is one decision of an editor on a submitted post
+type Review struct {
+	Id       string       `json:"id"`
+	Reviewer string       `json:"reviewer"`
+	Decision string       `json:"decision"` // StatusApproved or StatusChangesRequested
+	Summary  string       `json:"summary,omitempty"`
+	Revision int          `json:"revision"` // see revisions.go
+	Notes    []ReviewNote `json:"notes"`
+	Date     time.Time    `json:"date"`
+}
+
+type ReviewRequest struct {
+	Summary string `json:"summary"`
+	Notes   []struct {
+		Line int    `json:"line"` // 0 for a note on the whole post
+		Text string `json:"text"`
+	} `json:"notes"`
+}
+
+type RoleRequest struct {
+	Type string `json:"type"`
+}
+
+type CoAuthorsRequest struct {
+	CoAuthors []string `json:"coauthors"`
+}
+
+// reviews holds the decisions on every blog by blog id, oldest first
+var reviews = make(map[string][]Review)
+
+func isAdmin(username string) bool {
+	return users[username].Type == RoleAdmin
+}
+
+// isAuthor is true for the author and the co-authors of blog
+func isAuthor(username string, blog Blog) bool {
+	if blog.Author == username {
+		return true
+	}
+	for _, coAuthor := range blog.CoAuthors {
+		if coAuthor == username {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateApproval sends a post back to draft when someone who is not an
+// editor changes it. An approval covers the text the editor read, not what a
+// writer changes afterwards, so a published post goes offline until the new
+// text is approved. An editor's own edit counts as approved.
+func invalidateApproval(username string, blog *Blog) {
+	if isEditor(username) {
+		if blog.Status != StatusDraft && blog.Status != StatusInReview && blog.Status != StatusChangesRequested {
+			blog.ApprovedAt = blog.UpdatedAt
+		}
+		return
+	}
+	switch blog.Status {
+	case StatusInReview, StatusApproved, StatusScheduled, StatusPublished, StatusArchived:
+		blog.Status = StatusDraft
+		blog.PublishAt = nil
+	}
+}
+
+// SetRole changes the role of a user. Editors can promote writers to
+// editors, anything else takes an admin. The last admin cannot step down so
+// the platform always has one.
+func SetRole(c *fiber.Ctx) error {
+	username := c.Params("username")
+	req := new(RoleRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if req.Type != RoleWriter && req.Type != RoleEditor && req.Type != RoleAdmin {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "type must be writer, editor or admin"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	caller := currentUser(c)
+	if !isEditor(caller) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors and admins can change roles"})
+	}
+	user, exists := users[username]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+	if !isAdmin(caller) && (user.Type != RoleWriter || req.Type != RoleEditor) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "editors can only promote writers to editor"})
+	}
+	if user.Type == RoleAdmin && req.Type != RoleAdmin {
+		admins := 0
+		for _, other := range users {
+			if other.Type == RoleAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "cannot remove the last admin"})
+		}
+	}
+
+	user.Type = req.Type
+	users[username] = user
+	return c.JSON(fiber.Map{"user_name": username, "type": user.Type})
+}
+
+// SetCoAuthors replaces the co-authors of a post. They can edit it and submit
+// it for review like the author, but only the author or an editor can change
+// the list or delete the post.
+func SetCoAuthors(c *fiber.Ctx) error {
+	blogID := c.Params("id")
+	req := new(CoAuthorsRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[blogID]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	if username := currentUser(c); blog.Author != username && !isEditor(username) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author or an editor can change the co-authors"})
+	}
+
+	coAuthors := []string{}
+	seen := map[string]bool{blog.Author: true}
+	for _, username := range req.CoAuthors {
+		if seen[username] {
+			continue
+		}
+		if _, exists := users[username]; !exists {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "user " + username + " not found"})
+		}
+		seen[username] = true
+		coAuthors = append(coAuthors, username)
+	}
+
+	blog.CoAuthors = coAuthors
+	blogs[blogID] = blog
+	return c.JSON(blog)
+}
+
+// SubmitForReview hands a draft to the editors
+func SubmitForReview(c *fiber.Ctx) error {
+	return setStatus(c, StatusInReview, StatusDraft, StatusChangesRequested)
+}
+
+// withReview runs fn with the mutex held on the blog in the :id parameter
+// once the caller is allowed to review it. Editors review, but not posts they
+// wrote themselves unless they are admins.
+func withReview(c *fiber.Ctx, fn func(blog Blog) error) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	username := currentUser(c)
+	blog, exists := blogs[c.Params("id")]
+	if !exists || !isVisible(username, blog) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	if !isEditor(username) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors can review posts"})
+	}
+	if isAuthor(username, blog) && !isAdmin(username) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "another editor has to review your own post"})
+	}
+	if blog.Status != StatusInReview {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "blog is not in review"})
+	}
+	return fn(blog)
+}
+
+// newReview records the decision of the caller on blog and moves it to the
+// matching status. Caller must hold the mutex.
+func newReview(c *fiber.Ctx, blog Blog, decision string, req *ReviewRequest) error {
+	review := Review{
+		Id:       uuid.New().String(),
+		Reviewer: currentUser(c),
+		Decision: decision,
+		Summary:  strings.TrimSpace(req.Summary),
+		Revision: len(revisions[blog.Id]),
+		Notes:    []ReviewNote{},
+		Date:     time.Now(),
+	}
+
+	lines := strings.Split(blog.Content, "\n")
+	for _, n := range req.Notes {
+		note := ReviewNote{Id: uuid.New().String(), Line: n.Line, Text: strings.TrimSpace(n.Text)}
+		if note.Text == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "notes need a text"})
+		}
+		if note.Line < 0 || note.Line > len(lines) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "note line is outside the post"})
+		}
+		if note.Line > 0 {
+			note.Quote = lines[note.Line-1]
+		}
+		review.Notes = append(review.Notes, note)
+	}
+	if decision == StatusChangesRequested && review.Summary == "" && len(review.Notes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "say what has to change in summary or notes"})
+	}
+
+	reviews[blog.Id] = append(reviews[blog.Id], review)
+	blog.Status = decision
+	if decision == StatusApproved {
+		blog.ApprovedAt = review.Date
+	}
+	blogs[blog.Id] = blog
+	return c.JSON(fiber.Map{"blog": blog, "review": review})
+}
+
+func parseReviewRequest(c *fiber.Ctx) (*ReviewRequest, error) {
+	req := new(ReviewRequest)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// ApproveBlog marks a post in review as ready to publish
+func ApproveBlog(c *fiber.Ctx) error {
+	req, err := parseReviewRequest(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	return withReview(c, func(blog Blog) error {
+		return newReview(c, blog, StatusApproved, req)
+	})
+}
+
+// RequestChanges sends a post in review back to its authors with a summary
+// and notes, optionally on single lines
+func RequestChanges(c *fiber.Ctx) error {
+	req, err := parseReviewRequest(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	return withReview(c, func(blog Blog) error {
+		return newReview(c, blog, StatusChangesRequested, req)
+	})
+}
+
+// GetReviews lists the review history of a post to its authors and editors
+func GetReviews(c *fiber.Ctx) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[c.Params("id")]
+	if !exists || !canModify(currentUser(c), blog) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	result := reviews[blog.Id]
+	if result == nil {
+		result = []Review{}
+	}
+	return c.JSON(result)
+}
+
+// ResolveNote marks a review note as dealt with
+func ResolveNote(c *fiber.Ctx) error {
+	blogID, noteID := c.Params("id"), c.Params("note")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[blogID]
+	if !exists || !canModify(currentUser(c), blog) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	for _, review := range reviews[blogID] {
+		for i := range review.Notes {
+			if review.Notes[i].Id == noteID {
+				review.Notes[i].Resolved = true
+				return c.JSON(review.Notes[i])
+			}
+		}
+	}
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "note not found"})
+}
+
+// ReviewQueue lists the posts waiting for review, longest waiting first
+func ReviewQueue(c *fiber.Ctx) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isEditor(currentUser(c)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only editors can see the review queue"})
+	}
+	result := []Blog{}
+	for _, blog := range blogs {
+		if blog.Status == StatusInReview {
+			result = append(result, blog)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UpdatedAt.Before(result[j].UpdatedAt) })
+	return c.JSON(result)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// testApp serves the routes the review tests go through, on fresh data with
+// a writer and an editor
+func testApp(t *testing.T) *fiber.App {
+	t.Helper()
+	mutex.Lock()
+	users = map[string]User{
+		"writer": {UserName: "writer", Type: RoleWriter},
+		"editor": {UserName: "editor", Type: RoleEditor},
+	}
+	blogs = make(map[string]Blog)
+	slugs = make(map[string]string)
+	revisions = make(map[string][]Revision)
+	reviews = make(map[string][]Review)
+	mutex.Unlock()
+
+	app := fiber.New(fiber.Config{Immutable: true})
+	app.Get("/blog/:slug", optionalJWT, ViewBlogBySlug)
+	app.Use(jwtMiddleware)
+	app.Post("/blog/update/:id", UpdateBlogs)
+	app.Post("/blog/publish/:id", PublishBlog)
+	app.Post("/blog/archive/:id", ArchiveBlog)
+	return app
+}
+
+// publishedBlog stores a post by writer that an editor approved and published
+func publishedBlog(t *testing.T) Blog {
+	t.Helper()
+	approved := time.Now().Add(-time.Hour)
+	blog := Blog{
+		Id:          "post",
+		Title:       "Approved",
+		Content:     "approved text",
+		Slug:        "approved",
+		Author:      "writer",
+		Tags:        []string{},
+		CoAuthors:   []string{},
+		Date:        approved,
+		UpdatedAt:   approved,
+		Status:      StatusPublished,
+		PublishedAt: approved,
+		ApprovedAt:  approved,
+	}
+	mutex.Lock()
+	blogs[blog.Id] = blog
+	slugs[blog.Slug] = blog.Id
+	mutex.Unlock()
+	return blog
+}
+
+func send(t *testing.T, app *fiber.App, method, path, username, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if username != "" {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"username": username,
+			"type":     users[username].Type,
+			"exp":      time.Now().Add(time.Hour).Unix(),
+		})
+		signed, err := token.SignedString(jwtSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+signed)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+const rewrite = `{"title": "Approved", "content": "unreviewed text"}`
+
+func TestWriterEditTakesPublishedPostOffline(t *testing.T) {
+	app := testApp(t)
+	blog := publishedBlog(t)
+
+	if code := send(t, app, "POST", "/blog/update/"+blog.Id, "writer", rewrite); code != http.StatusOK {
+		t.Fatalf("update: got %d", code)
+	}
+	if code := send(t, app, "GET", "/blog/"+blog.Slug, "", ""); code != http.StatusNotFound {
+		t.Errorf("unreviewed edit is public: got %d", code)
+	}
+	if code := send(t, app, "POST", "/blog/publish/"+blog.Id, "writer", ""); code != http.StatusConflict {
+		t.Errorf("writer republished without review: got %d", code)
+	}
+}
+
+func TestEditorEditStaysPublished(t *testing.T) {
+	app := testApp(t)
+	blog := publishedBlog(t)
+
+	if code := send(t, app, "POST", "/blog/update/"+blog.Id, "editor", rewrite); code != http.StatusOK {
+		t.Fatalf("update: got %d", code)
+	}
+	if code := send(t, app, "GET", "/blog/"+blog.Slug, "", ""); code != http.StatusOK {
+		t.Errorf("editor's edit went offline: got %d", code)
+	}
+}
+
+func TestWriterCannotRepublishEditedArchive(t *testing.T) {
+	app := testApp(t)
+	blog := publishedBlog(t)
+
+	if code := send(t, app, "POST", "/blog/archive/"+blog.Id, "writer", ""); code != http.StatusOK {
+		t.Fatalf("archive: got %d", code)
+	}
+	if code := send(t, app, "POST", "/blog/update/"+blog.Id, "writer", rewrite); code != http.StatusOK {
+		t.Fatalf("update: got %d", code)
+	}
+	if code := send(t, app, "POST", "/blog/publish/"+blog.Id, "writer", ""); code != http.StatusConflict {
+		t.Errorf("edited archive republished without review: got %d", code)
+	}
+	if code := send(t, app, "GET", "/blog/"+blog.Slug, "", ""); code != http.StatusNotFound {
+		t.Errorf("unreviewed edit is public: got %d", code)
+	}
+}
+
+func TestIsPublishableArchived(t *testing.T) {
+	approved := time.Now().Add(-time.Hour)
+	blog := Blog{Status: StatusArchived, PublishedAt: approved, ApprovedAt: approved, UpdatedAt: approved}
+	if !isPublishable(blog) {
+		t.Error("archived post unchanged since approval is not publishable")
+	}
+	blog.UpdatedAt = approved.Add(time.Minute)
+	if isPublishable(blog) {
+		t.Error("archived post changed after approval is publishable")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Revision is a blog as it was saved at one point, numbered from 1 per blog
+type Revision struct {
+	Number       int       `json:"number"`
+	Title        string    `json:"title"`
+	Content      string    `json:"content"`
+	Tags         []string  `json:"tags"`
+	Category     string    `json:"category,omitempty"`
+	Author       string    `json:"author"` // who saved it, an editor may save someone else's post
+	Date         time.Time `json:"date"`
+	RestoredFrom int       `json:"restored_from,omitempty"` // set when the save restored an older revision
+}
+
+// DiffLine is one line of a diff. OldLine and NewLine are 1-based line
+// numbers in the two revisions, 0 when the line is not in that side.
+type DiffLine struct {
+	Op      string `json:"op"` // equal, insert or delete
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+	Text    string `json:"text"`
+}
+
+type RevisionDiff struct {
+	From    int        `json:"from"`
+	To      int        `json:"to"`
+	Title   []string   `json:"title,omitempty"` // old and new title when it changed
+	Added   int        `json:"added"`
+	Removed int        `json:"removed"`
+	Lines   []DiffLine `json:"lines"`
+}
+
+// revisions holds the history of every blog by blog id, oldest first
+var revisions = make(map[string][]Revision)
+
+// recordRevision keeps the current state of blog as its next revision.
+// Caller must hold the mutex.
+func recordRevision(blog Blog, author string, restoredFrom int) {
+	revisions[blog.Id] = append(revisions[blog.Id], Revision{
+		Number:       len(revisions[blog.Id]) + 1,
+		Title:        blog.Title,
+		Content:      blog.Content,
+		Tags:         blog.Tags,
+		Category:     blog.Category,
+		Author:       author,
+		Date:         blog.UpdatedAt,
+		RestoredFrom: restoredFrom,
+	})
+}
+
+// diffLines compares two texts line by line
+func diffLines(from, to string) ([]DiffLine, int, int) {
+	// without a final newline the last line would differ from the same line
+	// followed by more text
+	if from != "" && !strings.HasSuffix(from, "\n") {
+		from += "\n"
+	}
+	if to != "" && !strings.HasSuffix(to, "\n") {
+		to += "\n"
+	}
+
+	dmp := diffmatchpatch.New()
+	fromChars, toChars, lineArray := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(fromChars, toChars, false), lineArray)
+
+	lines := []DiffLine{}
+	oldLine, newLine, added, removed := 0, 0, 0, 0
+	for _, diff := range diffs {
+		for _, text := range strings.SplitAfter(diff.Text, "\n") {
+			if text == "" {
+				continue
+			}
+			line := DiffLine{Text: strings.TrimSuffix(text, "\n")}
+			switch diff.Type {
+			case diffmatchpatch.DiffEqual:
+				oldLine++
+				newLine++
+				line.Op, line.OldLine, line.NewLine = "equal", oldLine, newLine
+			case diffmatchpatch.DiffDelete:
+				oldLine++
+				removed++
+				line.Op, line.OldLine = "delete", oldLine
+			case diffmatchpatch.DiffInsert:
+				newLine++
+				added++
+				line.Op, line.NewLine = "insert", newLine
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines, added, removed
+}
+
+// withHistory runs fn with the mutex held on the blog in the :id parameter,
+// whose history only its author and editors may see or restore
+func withHistory(c *fiber.Ctx, fn func(blog Blog) error) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[c.Params("id")]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+	if !canModify(currentUser(c), blog) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the author or an editor can see the history of this blog"})
+	}
+	return fn(blog)
+}
+
+// findRevision parses a revision number of blogID. Caller must hold the mutex.
+func findRevision(blogID, number string) (Revision, bool) {
+	n, err := strconv.Atoi(number)
+	history := revisions[blogID]
+	if err != nil || n < 1 || n > len(history) {
+		return Revision{}, false
+	}
+	return history[n-1], true
+}
+
+func GetRevisions(c *fiber.Ctx) error {
+	return withHistory(c, func(blog Blog) error {
+		return c.JSON(revisions[blog.Id])
+	})
+}
+
+func GetRevision(c *fiber.Ctx) error {
+	return withHistory(c, func(blog Blog) error {
+		revision, found := findRevision(blog.Id, c.Params("rev"))
+		if !found {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "revision not found"})
+		}
+		return c.JSON(revision)
+	})
+}
+
+// DiffRevisions compares revision ?from= with revision ?to=. Without
+// parameters it shows what the latest save changed.
+func DiffRevisions(c *fiber.Ctx) error {
+	return withHistory(c, func(blog Blog) error {
+		latest := len(revisions[blog.Id])
+		to, found := findRevision(blog.Id, c.Query("to", strconv.Itoa(latest)))
+		if !found {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "revision not found"})
+		}
+		from := Revision{} // diffing the first revision against nothing shows it all as added
+		if to.Number > 1 || c.Query("from") != "" {
+			from, found = findRevision(blog.Id, c.Query("from", strconv.Itoa(to.Number-1)))
+			if !found {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "revision not found"})
+			}
+		}
+
+		diff := RevisionDiff{From: from.Number, To: to.Number}
+		if from.Title != to.Title {
+			diff.Title = []string{from.Title, to.Title}
+		}
+		diff.Lines, diff.Added, diff.Removed = diffLines(from.Content, to.Content)
+		return c.JSON(diff)
+	})
+}
+
+// RestoreRevision makes an old revision the current version. It is saved as
+// a new revision, so the history is never rewritten.
+func RestoreRevision(c *fiber.Ctx) error {
+	return withHistory(c, func(blog Blog) error {
+		revision, found := findRevision(blog.Id, c.Params("rev"))
+		if !found {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "revision not found"})
+		}
+
+		html, err := renderMarkdown(revision.Content)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not render content"})
+		}
+
+		blog.Title = revision.Title
+		blog.Content = revision.Content
+		blog.ContentHTML = html
+		blog.Tags = revision.Tags
+		blog.Category = revision.Category
+		if _, exists := categories[blog.Category]; !exists {
+			blog.Category = "" // deleted since
+		}
+		blog.UpdatedAt = time.Now()
+		invalidateApproval(currentUser(c), &blog)
+		assignSlug(&blog)
+		blogs[blog.Id] = blog
+		recordRevision(blog, currentUser(c), revision.Number)
+
+		return c.JSON(blog)
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gosimple/slug"
+)
+
+// slugs longer than this are cut at the last word that fits
+const maxSlugLength = 80
+
+// slugs maps every slug a blog ever had to its id. The current one is
+// Blog.Slug, the others redirect to it.
+var slugs = make(map[string]string)
+
+// baseSlug transliterates the title to lower case ASCII words joined by dashes
+func baseSlug(title string) string {
+	base := slug.Make(title)
+	if len(base) > maxSlugLength {
+		base = base[:maxSlugLength]
+		if cut := strings.LastIndex(base, "-"); cut > 0 {
+			base = base[:cut]
+		}
+	}
+	if base == "" {
+		base = "post"
+	}
+	return base
+}
+
+// uniqueSlug picks a slug for blogID, adding -2, -3 and so on when another
+// blog holds it. A blog can take back one of its own old slugs. Caller must
+// hold the mutex.
+func uniqueSlug(title, blogID string) string {
+	base := baseSlug(title)
+	candidate := base
+	for n := 2; ; n++ {
+		if owner, taken := slugs[candidate]; !taken || owner == blogID {
+			return candidate
+		}
+		candidate = base + "-" + strconv.Itoa(n)
+	}
+}
+
+// assignSlug gives blog a slug for its current title. The slug only changes
+// when uniqueSlug picks a different one, so a post keeps its -2 suffix while
+// the title still collides. Old slugs stay mapped to the blog so links to them
+// keep working.
+func assignSlug(blog *Blog) {
+	slug := uniqueSlug(blog.Title, blog.Id)
+	if slug == blog.Slug {
+		return
+	}
+	blog.Slug = slug
+	slugs[slug] = blog.Id
+}
+
+// removeSlugs frees every slug of a deleted blog
+func removeSlugs(blogID string) {
+	for s, id := range slugs {
+		if id == blogID {
+			delete(slugs, s)
+		}
+	}
+}
+
+// ViewBlogBySlug serves a blog at its permalink, old slugs answer with a
+// permanent redirect to the current one
+func ViewBlogBySlug(c *fiber.Ctx) error {
+	requested := c.Params("slug")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	blog, exists := blogs[slugs[requested]]
+	if !exists || !isVisible(currentUser(c), blog) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "blog not found"})
+	}
+
+	if blog.Slug != requested {
+		location := "/blog/" + blog.Slug
+		if query := string(c.Request().URI().QueryString()); query != "" {
+			location += "?" + query
+		}
+		return c.Redirect(location, fiber.StatusMovedPermanently)
+	}
+	recordView(c, blog)
+	return sendBlog(c, blog)
+}
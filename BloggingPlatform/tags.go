@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gosimple/slug"
+)
+
+// normalizeTags turns tags into their URL form, so "Go Lang" and "go-lang"
+// are the same tag, and drops empty ones and duplicates
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, tag := range tags {
+		tag = slug.Make(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	return result
+}
+
+func hasTag(blog Blog, tag string) bool {
+	for _, t := range blog.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// GetTags lists every tag used by a published post, most used first
+func GetTags(c *fiber.Ctx) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	counts := make(map[string]int)
+	for _, blog := range blogs {
+		if blog.Status == StatusPublished {
+			for _, tag := range blog.Tags {
+				counts[tag]++
+			}
+		}
+	}
+
+	result := []TagCount{}
+	for tag, count := range counts {
+		result = append(result, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Tag < result[j].Tag
+	})
+
+	return c.JSON(result)
+}
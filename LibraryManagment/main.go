@@ -2,7 +2,10 @@ package main
 
 import (
 	"github.com/gofiber/fiber/v2"
+	"log"
+	"strconv"
 	"sync"
+	"time"
 )
 
 func main() {
@@ -10,10 +13,14 @@ func main() {
 
 	books := router.Group("/books")
 	{
-		books.Post("/create") // these all routes are for admin because he only has the access to these things
-		books.Get("/view")
+		books.Post("/create", CreateBook) // these all routes are for admin because he only has the access to these things
+		books.Get("/view", ViewBook)
 		books.Put("/update") // this is for updation of details of the book
 		books.Delete("/delete")
+
+		books.Post("/borrow/:id", BorrowBook) // these are for members, limits come from their plan
+		books.Post("/return/:id", ReturnBook)
+		books.Post("/renew/:id", RenewBook)
 	}
 
 	router.Post("/user/create", CreateUser)
@@ -22,17 +29,31 @@ func main() {
 
 	router.Post("/user/update") // these two api's can be shown in a single way so he will know
 
+	plans := router.Group("/plans") // admin only
+	{
+		plans.Post("/create", CreatePlan)
+		plans.Get("/view", ViewPlans)
+		plans.Post("/assign", AssignPlan)
+		plans.Get("/expiring", ExpiringMemberships)
+	}
+
+	log.Fatal(router.Listen(":3000"))
 }
 
 var (
-	users = make(map[string]User)
-	books = make(map[string]int)
-	mutex = &sync.Mutex{}
+	users            = make(map[string]User)
+	books            = make(map[int32]Book)
+	loans            = make(map[int32]Loan)
+	nextBookID int32 = 1
+	nextLoanID int32 = 1
+	mutex            = &sync.Mutex{}
 )
 
 type User struct {
-	UserName string `json:"user_name"`
-	Type     string `json:"type"` // can be admin or user
+	UserName         string    `json:"user_name"`
+	Type             string    `json:"type"` // can be admin or user
+	Plan             string    `json:"plan"` // name of the membership plan, assigned by admin
+	MembershipExpiry time.Time `json:"membership_expiry"`
 }
 
 type Book struct {
@@ -43,6 +64,16 @@ type Book struct {
 	Availability string `json:"availability"` // we can also consider it as boolean
 }
 
+type Loan struct {
+	Id         int32     `json:"id"`
+	BookId     int32     `json:"book_id"`
+	UserName   string    `json:"user_name"`
+	BorrowedAt time.Time `json:"borrowed_at"`
+	DueDate    time.Time `json:"due_date"`
+	Renewals   int       `json:"renewals"`
+	Returned   bool      `json:"returned"`
+}
+
 func CreateUser(c *fiber.Ctx) error {
 	user := new(User)
 	if err := c.BodyParser(user); err != nil {
@@ -55,6 +86,16 @@ func CreateUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "user already exists"})
 	}
 
+	// roles are set here, never from the body: the first account runs the
+	// library, everyone after is a member. Membership is only given out by an
+	// admin through /plans/assign.
+	user.Type = "user"
+	if len(users) == 0 {
+		user.Type = "admin"
+	}
+	user.Plan = ""
+	user.MembershipExpiry = time.Time{}
+
 	users[user.UserName] = *user
 	return c.Status(fiber.StatusCreated).JSON(user)
 }
@@ -73,10 +114,12 @@ func CreateBook(c *fiber.Ctx) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	loanID := nextLoanID
-	nextLoanID++
+	book.Id = nextBookID
+	nextBookID++
+	book.Availability = "available"
+	books[book.Id] = *book
 
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"loan_id": loanID})
+	return c.Status(fiber.StatusCreated).JSON(book)
 }
 
 func ViewBook(c *fiber.Ctx) error {
@@ -89,10 +132,125 @@ func ViewBook(c *fiber.Ctx) error {
 	defer mutex.Unlock()
 
 	var result []Book
-	for _, loanID := range books[id] {
-		loan := loans[loanID]
-		result = append(result, loan)
+	for _, book := range books {
+		result = append(result, book)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(result)
 }
+
+func BorrowBook(c *fiber.Ctx) error {
+	bookID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid book id"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	user, ok := users[c.Query("username")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+
+	plan, err := activePlan(user, time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	book, exists := books[int32(bookID)]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "book not found"})
+	}
+	if book.Availability != "available" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "book is already borrowed"})
+	}
+
+	if activeLoans(user.UserName) >= plan.MaxBorrows {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "borrow limit reached for plan " + plan.Name})
+	}
+
+	now := time.Now()
+	loan := Loan{
+		Id:         nextLoanID,
+		BookId:     book.Id,
+		UserName:   user.UserName,
+		BorrowedAt: now,
+		DueDate:    now.AddDate(0, 0, plan.LoanPeriodDays),
+	}
+	nextLoanID++
+	loans[loan.Id] = loan
+
+	book.Availability = "borrowed"
+	books[book.Id] = book
+
+	return c.Status(fiber.StatusCreated).JSON(loan)
+}
+
+func ReturnBook(c *fiber.Ctx) error {
+	loanID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid loan id"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	loan, exists := loans[int32(loanID)]
+	if !exists || loan.UserName != c.Query("username") {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "loan not found"})
+	}
+	if loan.Returned {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "book already returned"})
+	}
+
+	loan.Returned = true
+	loans[loan.Id] = loan
+
+	if book, ok := books[loan.BookId]; ok {
+		book.Availability = "available"
+		books[book.Id] = book
+	}
+
+	return c.Status(fiber.StatusOK).JSON(loan)
+}
+
+func RenewBook(c *fiber.Ctx) error {
+	loanID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid loan id"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	loan, exists := loans[int32(loanID)]
+	if !exists || loan.UserName != c.Query("username") || loan.Returned {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "loan not found"})
+	}
+
+	plan, err := activePlan(users[loan.UserName], time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	if loan.Renewals >= plan.MaxRenewals {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "no renewals left for plan " + plan.Name})
+	}
+
+	loan.Renewals++
+	loan.DueDate = loan.DueDate.AddDate(0, 0, plan.LoanPeriodDays)
+	loans[loan.Id] = loan
+
+	return c.Status(fiber.StatusOK).JSON(loan)
+}
+
+// activeLoans counts the books a user currently holds, caller must hold the mutex
+func activeLoans(userName string) int {
+	count := 0
+	for _, loan := range loans {
+		if loan.UserName == userName && !loan.Returned {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type MembershipPlan struct {
+	Name           string `json:"name"`
+	MaxBorrows     int    `json:"max_borrows"`      // books a member can hold at the same time
+	LoanPeriodDays int    `json:"loan_period_days"` // how long a single loan lasts
+	MaxRenewals    int    `json:"max_renewals"`     // how many times one loan can be extended
+	DurationDays   int    `json:"duration_days"`    // default membership length when assigned
+}
+
+type AssignPlanRequest struct {
+	UserName  string    `json:"user_name"`
+	Plan      string    `json:"plan"`
+	ExpiresAt time.Time `json:"expires_at"` // optional, otherwise plan duration from now
+}
+
+// default plans, admins can add more or overwrite these through /plans/create
+var plans = map[string]MembershipPlan{
+	"student":  {Name: "student", MaxBorrows: 2, LoanPeriodDays: 14, MaxRenewals: 1, DurationDays: 180},
+	"standard": {Name: "standard", MaxBorrows: 5, LoanPeriodDays: 21, MaxRenewals: 2, DurationDays: 365},
+	"premium":  {Name: "premium", MaxBorrows: 10, LoanPeriodDays: 30, MaxRenewals: 5, DurationDays: 365},
+}
+
+// activePlan returns the plan a user can borrow under right now, caller must hold the mutex
+func activePlan(user User, now time.Time) (MembershipPlan, error) {
+	if user.Plan == "" {
+		return MembershipPlan{}, errors.New("user has no membership plan")
+	}
+	plan, ok := plans[user.Plan]
+	if !ok {
+		return MembershipPlan{}, errors.New("membership plan " + user.Plan + " no longer exists")
+	}
+	if !user.MembershipExpiry.IsZero() && now.After(user.MembershipExpiry) {
+		return MembershipPlan{}, errors.New("membership expired")
+	}
+	return plan, nil
+}
+
+func isAdmin(c *fiber.Ctx) bool {
+	user, ok := users[c.Query("username")]
+	return ok && user.Type == "admin"
+}
+
+func CreatePlan(c *fiber.Ctx) error {
+	plan := new(MembershipPlan)
+	if err := c.BodyParser(plan); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	if plan.Name == "" || plan.MaxBorrows <= 0 || plan.LoanPeriodDays <= 0 || plan.MaxRenewals < 0 || plan.DurationDays <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name, max_borrows, loan_period_days and duration_days are required"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "admin access required"})
+	}
+
+	plans[plan.Name] = *plan
+	return c.Status(fiber.StatusCreated).JSON(plan)
+}
+
+func ViewPlans(c *fiber.Ctx) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "admin access required"})
+	}
+
+	result := make([]MembershipPlan, 0, len(plans))
+	for _, plan := range plans {
+		result = append(result, plan)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+func AssignPlan(c *fiber.Ctx) error {
+	req := new(AssignPlanRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "admin access required"})
+	}
+
+	user, ok := users[req.UserName]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+	plan, ok := plans[req.Plan]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "plan not found"})
+	}
+
+	user.Plan = plan.Name
+	user.MembershipExpiry = req.ExpiresAt
+	if user.MembershipExpiry.IsZero() {
+		user.MembershipExpiry = time.Now().AddDate(0, 0, plan.DurationDays)
+	}
+	users[user.UserName] = user
+
+	return c.Status(fiber.StatusOK).JSON(user)
+}
+
+// ExpiringMemberships lists members whose plan runs out in the next ?days= days (30 by default)
+func ExpiringMemberships(c *fiber.Ctx) error {
+	days := 30
+	if raw := c.Query("days"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid days"})
+		}
+		days = parsed
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !isAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "admin access required"})
+	}
+
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, days)
+
+	result := []User{}
+	for _, user := range users {
+		if user.Plan == "" || user.MembershipExpiry.IsZero() {
+			continue
+		}
+		if user.MembershipExpiry.After(now) && !user.MembershipExpiry.After(cutoff) {
+			result = append(result, user)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].MembershipExpiry.Before(result[j].MembershipExpiry) })
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
@@ -0,0 +1,14 @@
+package main
+
+import "fmt"
+
+// runCommand runs a maintenance command instead of the server:
+//
+//	rebuild-timelines  push every existing post to the timelines
+func runCommand(name string) error {
+	switch name {
+	case "rebuild-timelines":
+		return DB.Transaction(rebuildTimelines)
+	}
+	return fmt.Errorf("unknown command %q, expected rebuild-timelines", name)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultFeedLimit = 20
+	maxFeedLimit     = 100
+)
+
+// FeedCursor marks the last post of a page. The next page starts right after
+// it in (timestamp, id) order, so posts created meanwhile don't shift pages.
+type FeedCursor struct {
+	Timestamp time.Time
+	PostID    string
+}
+
+type FeedPage struct {
+	Posts      []Post `json:"posts"`
+	NextCursor string `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+var errBadCursor = errors.New("invalid cursor")
+
+func (cursor FeedCursor) Encode() string {
+	raw := cursor.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + cursor.PostID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeFeedCursor(s string) (*FeedCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	timestamp, postID, found := strings.Cut(string(raw), "|")
+	if !found || postID == "" {
+		return nil, errBadCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	return &FeedCursor{Timestamp: t, PostID: postID}, nil
+}
+
+// newestFirst orders posts for a feed and skips to after the cursor
+func newestFirst(query *gorm.DB, cursor *FeedCursor) *gorm.DB {
+	if cursor != nil {
+		query = query.Where("posts.timestamp < ? OR (posts.timestamp = ? AND posts.id < ?)",
+			cursor.Timestamp, cursor.Timestamp, cursor.PostID)
+	}
+	return query.Order("posts.timestamp DESC").Order("posts.id DESC")
+}
+
+// withAuthors loads the author of each post without the password
+func withAuthors(query *gorm.DB) *gorm.DB {
+	return query.Preload("User", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "username")
+	})
+}
+
+// feedPage cuts one extra post off the end of posts, which was only fetched
+// to tell whether there is a next page
+func feedPage(posts []Post, limit int) FeedPage {
+	page := FeedPage{Posts: posts}
+	if len(posts) > limit {
+		page.Posts = posts[:limit]
+		last := page.Posts[limit-1]
+		page.NextCursor = FeedCursor{Timestamp: last.Timestamp, PostID: last.ID}.Encode()
+	}
+	return page
+}
+
+// pullFeed builds a page of the home timeline by reading the posts of the
+// followed users at request time
+func pullFeed(userID string, cursor *FeedCursor, limit int) (FeedPage, error) {
+	followed := DB.Model(&Follow{}).Select("followed_id").Where("follower_id = ?", userID)
+
+	var posts []Post
+	query := DB.Where("posts.user_id IN (?) OR posts.user_id = ?", followed, userID)
+	err := withAuthors(newestFirst(query, cursor)).Limit(limit + 1).Find(&posts).Error
+	if err != nil {
+		return FeedPage{}, err
+	}
+	return feedPage(posts, limit), nil
+}
+
+func parseFeedLimit(c *fiber.Ctx) (int, error) {
+	limit := defaultFeedLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxFeedLimit {
+			return 0, errors.New("limit must be between 1 and " + strconv.Itoa(maxFeedLimit))
+		}
+		limit = n
+	}
+	return limit, nil
+}
+
+// getFeed returns the home timeline: posts of the users the caller follows and
+// their own, newest first. Pass next_cursor back as ?cursor= for the next page.
+func getFeed(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	limit, err := parseFeedLimit(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	cursor, err := decodeFeedCursor(c.Query("cursor"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	page, err := timelineFeed(userID, cursor, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not retrieve feed"})
+	}
+	return c.JSON(page)
+}
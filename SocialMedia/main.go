@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -18,20 +19,21 @@ type User struct {
 	ID       string `gorm:"primaryKey"`
 	Username string `gorm:"unique"`
 	Password string
+	Pulled   bool `gorm:"not null;default:false" json:"-"` // too many followers to push posts to, see fanOut
 }
 
 type Post struct {
 	ID        string `gorm:"primaryKey"`
 	Content   string
-	Timestamp time.Time
-	UserID    string
+	Timestamp time.Time `gorm:"index:idx_posts_user_timestamp,priority:2"`
+	UserID    string    `gorm:"index:idx_posts_user_timestamp,priority:1"`
 	User      User
 }
 
 type Follow struct {
 	ID         string `gorm:"primaryKey"`
-	FollowerID string // haan to isee pta lg jaayega na ki kis kisko follow kr rha hai
-	FollowedID string
+	FollowerID string `gorm:"index"` // haan to isee pta lg jaayega na ki kis kisko follow kr rha hai
+	FollowedID string `gorm:"index"`
 }
 
 type Like struct {
@@ -49,7 +51,7 @@ func ConnectDatabase() {
 
 	DB = database
 
-	err = DB.AutoMigrate(&User{}, &Post{}, &Follow{}, &Like{})
+	err = DB.AutoMigrate(&User{}, &Post{}, &Follow{}, &Like{}, &TimelineEntry{})
 	if err != nil {
 		log.Fatal("failed to migrate database: ", err)
 	}
@@ -58,6 +60,13 @@ func ConnectDatabase() {
 func main() {
 	ConnectDatabase()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	app := fiber.New()
 
 	app.Post("/register", register)
@@ -69,6 +78,8 @@ func main() {
 	app.Post("/users/:id/follow", followUser)
 	app.Delete("/users/:id/unfollow", unfollowUser)
 
+	app.Get("/feed", getFeed)
+
 	app.Post("/posts", createPost)
 	app.Get("/posts", getAllPosts)
 	app.Get("/posts/:id", getPost)
@@ -165,7 +176,13 @@ func followUser(c *fiber.Ctx) error {
 		FollowedID: followedID,
 	}
 
-	if err := DB.Create(&follow).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&follow).Error; err != nil {
+			return err
+		}
+		return backfillTimeline(tx, followerID, followedID)
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not follow user"})
 	}
 
@@ -176,7 +193,13 @@ func unfollowUser(c *fiber.Ctx) error {
 	followerID := c.Locals("userID").(string)
 	followedID := c.Params("id")
 
-	if err := DB.Where("follower_id = ? AND followed_id = ?", followerID, followedID).Delete(&Follow{}).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("follower_id = ? AND followed_id = ?", followerID, followedID).Delete(&Follow{}).Error; err != nil {
+			return err
+		}
+		return dropFromTimeline(tx, followerID, followedID)
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not unfollow user"})
 	}
 
@@ -195,7 +218,13 @@ func createPost(c *fiber.Ctx) error {
 	post.UserID = userID
 	post.Timestamp = time.Now()
 
-	if err := DB.Create(post).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(post).Error; err != nil {
+			return err
+		}
+		return fanOut(tx, post)
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not create post"})
 	}
 
@@ -247,7 +276,14 @@ func deletePost(c *fiber.Ctx) error {
 	id := c.Params("id")
 	userID := c.Locals("userID").(string)
 
-	if err := DB.Where("id = ? AND user_id = ?", id, userID).Delete(&Post{}).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND user_id = ?", id, userID).Delete(&Post{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return retractPost(tx, id)
+	})
+	if err != nil {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "you are not the owner of this post"})
 	}
 
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TimelineEntry puts a post on the home timeline of one user. Posts are pushed
+// to the followers of their author when they are written, so reading the feed
+// doesn't have to go through everyone the reader follows.
+type TimelineEntry struct {
+	UserID    string    `gorm:"primaryKey;index:idx_timeline_user_timestamp,priority:1"`
+	PostID    string    `gorm:"primaryKey;index"`
+	AuthorID  string    `gorm:"index"`
+	Timestamp time.Time `gorm:"index:idx_timeline_user_timestamp,priority:2"` // of the post
+}
+
+// Accounts with more followers than this are not pushed, writing that many
+// entries per post costs more than reading their posts when a follower loads
+// the feed. Once an account is pulled it stays pulled, see fanOut.
+var fanoutLimit int64 = 10000
+
+// feedRef is a post of a feed before the post itself is loaded
+type feedRef struct {
+	ID        string
+	Timestamp time.Time
+}
+
+func followerCount(tx *gorm.DB, userID string) (int64, error) {
+	var count int64
+	err := tx.Model(&Follow{}).Where("followed_id = ?", userID).Distinct("follower_id").Count(&count).Error
+	return count, err
+}
+
+// fanOut pushes a new post to the timelines of the author and their
+// followers. Authors above fanoutLimit are marked Pulled instead and their
+// followers read their posts at request time. Pulled is never cleared, posts
+// written while pulled are in nobody's timeline.
+func fanOut(tx *gorm.DB, post *Post) error {
+	var author User
+	if err := tx.Select("id", "pulled").First(&author, "id = ?", post.UserID).Error; err != nil {
+		return err
+	}
+	if !author.Pulled {
+		count, err := followerCount(tx, post.UserID)
+		if err != nil {
+			return err
+		}
+		if count > fanoutLimit {
+			author.Pulled = true
+			if err := tx.Model(&author).Update("pulled", true).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	// the author's own timeline, pulled or not
+	if err := tx.Exec(`INSERT INTO timeline_entries (user_id, post_id, author_id, timestamp)
+		VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		post.UserID, post.ID, post.UserID, post.Timestamp).Error; err != nil {
+		return err
+	}
+	if author.Pulled {
+		return nil
+	}
+	return tx.Exec(`INSERT INTO timeline_entries (user_id, post_id, author_id, timestamp)
+		SELECT DISTINCT follower_id, ?, ?, ? FROM follows WHERE followed_id = ? AND follower_id <> ?
+		ON CONFLICT DO NOTHING`,
+		post.ID, post.UserID, post.Timestamp, post.UserID, post.UserID).Error
+}
+
+// backfillTimeline adds the posts of a newly followed account to the
+// follower's timeline. Pulled accounts are read at request time anyway.
+func backfillTimeline(tx *gorm.DB, followerID, followedID string) error {
+	if followerID == followedID {
+		return nil // own posts are always on the timeline
+	}
+	return tx.Exec(`INSERT INTO timeline_entries (user_id, post_id, author_id, timestamp)
+		SELECT ?, posts.id, posts.user_id, posts.timestamp FROM posts
+		JOIN users ON users.id = posts.user_id
+		WHERE posts.user_id = ? AND NOT users.pulled
+		ON CONFLICT DO NOTHING`,
+		followerID, followedID).Error
+}
+
+// dropFromTimeline removes the posts of an unfollowed account from the
+// follower's timeline. Your own posts stay when you unfollow yourself, fanOut
+// skips the author among the followers the same way.
+func dropFromTimeline(tx *gorm.DB, followerID, followedID string) error {
+	if followerID == followedID {
+		return nil
+	}
+	return tx.Where("user_id = ? AND author_id = ?", followerID, followedID).Delete(&TimelineEntry{}).Error
+}
+
+// retractPost takes a deleted post off every timeline
+func retractPost(tx *gorm.DB, postID string) error {
+	return tx.Where("post_id = ?", postID).Delete(&TimelineEntry{}).Error
+}
+
+// rebuildTimelines fills the timelines from the follows and posts tables, for
+// posts written before timelines existed. Accounts above fanoutLimit become
+// pulled first.
+func rebuildTimelines(tx *gorm.DB) error {
+	popular := tx.Model(&Follow{}).Select("followed_id").Group("followed_id").Having("COUNT(DISTINCT follower_id) > ?", fanoutLimit)
+	if err := tx.Model(&User{}).Where("id IN (?)", popular).Update("pulled", true).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec(`INSERT INTO timeline_entries (user_id, post_id, author_id, timestamp)
+		SELECT user_id, id, user_id, timestamp FROM posts WHERE true
+		ON CONFLICT DO NOTHING`).Error; err != nil {
+		return err
+	}
+	return tx.Exec(`INSERT INTO timeline_entries (user_id, post_id, author_id, timestamp)
+		SELECT DISTINCT follows.follower_id, posts.id, posts.user_id, posts.timestamp FROM follows
+		JOIN posts ON posts.user_id = follows.followed_id
+		JOIN users ON users.id = posts.user_id
+		WHERE NOT users.pulled
+		ON CONFLICT DO NOTHING`).Error
+}
+
+// timelineFeed reads a page of the home timeline from the pushed entries and
+// merges in the posts of followed accounts that are pulled
+func timelineFeed(userID string, cursor *FeedCursor, limit int) (FeedPage, error) {
+	var pushed []feedRef
+	query := DB.Model(&TimelineEntry{}).Select("post_id AS id", "timestamp").Where("user_id = ?", userID)
+	if cursor != nil {
+		query = query.Where("timestamp < ? OR (timestamp = ? AND post_id < ?)",
+			cursor.Timestamp, cursor.Timestamp, cursor.PostID)
+	}
+	err := query.Order("timestamp DESC").Order("post_id DESC").Limit(limit + 1).Scan(&pushed).Error
+	if err != nil {
+		return FeedPage{}, err
+	}
+
+	var pulled []feedRef
+	followed := DB.Model(&Follow{}).Select("follows.followed_id").
+		Joins("JOIN users ON users.id = follows.followed_id").
+		Where("follows.follower_id = ? AND users.pulled", userID)
+	query = DB.Model(&Post{}).Select("posts.id", "posts.timestamp").Where("posts.user_id IN (?)", followed)
+	if err := newestFirst(query, cursor).Limit(limit + 1).Scan(&pulled).Error; err != nil {
+		return FeedPage{}, err
+	}
+
+	refs := mergeRefs(pushed, pulled)
+	page := FeedPage{Posts: []Post{}}
+	if len(refs) > limit {
+		refs = refs[:limit]
+		last := refs[limit-1]
+		page.NextCursor = FeedCursor{Timestamp: last.Timestamp, PostID: last.ID}.Encode()
+	}
+	if len(refs) == 0 {
+		return page, nil
+	}
+
+	ids := make([]string, len(refs))
+	for i, ref := range refs {
+		ids[i] = ref.ID
+	}
+	var posts []Post
+	if err := withAuthors(DB.Where("id IN ?", ids)).Find(&posts).Error; err != nil {
+		return FeedPage{}, err
+	}
+	byID := make(map[string]Post, len(posts))
+	for _, post := range posts {
+		byID[post.ID] = post
+	}
+	// a post deleted since the refs were read is left out, the cursor still
+	// comes from the refs so the next page doesn't skip anything
+	for _, ref := range refs {
+		if post, exists := byID[ref.ID]; exists {
+			page.Posts = append(page.Posts, post)
+		}
+	}
+	return page, nil
+}
+
+// mergeRefs combines both sources newest first. A post can be in both when its
+// author became pulled after it was pushed.
+func mergeRefs(pushed, pulled []feedRef) []feedRef {
+	seen := make(map[string]bool, len(pushed)+len(pulled))
+	refs := make([]feedRef, 0, len(pushed)+len(pulled))
+	for _, ref := range append(pushed, pulled...) {
+		if !seen[ref.ID] {
+			seen[ref.ID] = true
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if !refs[i].Timestamp.Equal(refs[j].Timestamp) {
+			return refs[i].Timestamp.After(refs[j].Timestamp)
+		}
+		return refs[i].ID > refs[j].ID
+	})
+	return refs
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Benchmarks run against the Postgres database in TEST_DATABASE_DSN, inside a
+// transaction that is rolled back afterwards:
+//
+//	TEST_DATABASE_DSN="host=localhost user=postgres dbname=social_media_test" go test -bench Feed -run '^$'
+const (
+	benchUsers       = 1000
+	benchFollows     = 50 // random accounts each user follows
+	benchCelebrities = 2  // accounts everyone follows, pulled
+	benchPosts       = 20 // per user
+)
+
+// benchNetwork seeds a generated network and points DB at it until the
+// benchmark ends. It returns the users, celebrities first.
+func benchNetwork(b *testing.B) []string {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("TEST_DATABASE_DSN is not set")
+	}
+	database, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := database.AutoMigrate(&User{}, &Post{}, &Follow{}, &Like{}, &TimelineEntry{}); err != nil {
+		b.Fatal(err)
+	}
+
+	tx := database.Begin()
+	if tx.Error != nil {
+		b.Fatal(tx.Error)
+	}
+	savedDB, savedLimit := DB, fanoutLimit
+	DB, fanoutLimit = tx, benchUsers/2
+	b.Cleanup(func() {
+		tx.Rollback()
+		DB, fanoutLimit = savedDB, savedLimit
+	})
+
+	ids, err := seedNetwork(tx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := rebuildTimelines(tx); err != nil {
+		b.Fatal(err)
+	}
+	return ids
+}
+
+// seedNetwork creates users with posts spread over the last 30 days. The
+// celebrities are followed by everyone, the rest follow random accounts.
+func seedNetwork(tx *gorm.DB) ([]string, error) {
+	random := rand.New(rand.NewSource(1))
+	now := time.Now()
+
+	ids := make([]string, benchUsers)
+	users := make([]User, benchUsers)
+	for i := range users {
+		ids[i] = uuid.New().String()
+		users[i] = User{ID: ids[i], Username: "bench-" + ids[i], Password: "-"}
+	}
+	if err := tx.CreateInBatches(users, 500).Error; err != nil {
+		return nil, err
+	}
+
+	var follows []Follow
+	for i, follower := range ids {
+		followed := make(map[int]bool)
+		for c := 0; c < benchCelebrities; c++ {
+			followed[c] = true
+		}
+		for len(followed) < benchFollows+benchCelebrities {
+			followed[random.Intn(benchUsers)] = true
+		}
+		for j := range followed {
+			if j != i {
+				follows = append(follows, Follow{ID: uuid.New().String(), FollowerID: follower, FollowedID: ids[j]})
+			}
+		}
+	}
+	if err := tx.CreateInBatches(follows, 1000).Error; err != nil {
+		return nil, err
+	}
+
+	var posts []Post
+	for _, author := range ids {
+		for p := 0; p < benchPosts; p++ {
+			age := time.Duration(random.Int63n(int64(30 * 24 * time.Hour)))
+			posts = append(posts, Post{ID: uuid.New().String(), Content: "bench", Timestamp: now.Add(-age), UserID: author})
+		}
+	}
+	if err := tx.CreateInBatches(posts, 1000).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// benchFeed reads the first page and the first three pages of random users'
+// feeds, then writes posts with write
+func benchFeed(b *testing.B, read func(string, *FeedCursor, int) (FeedPage, error), write func(*Post) error) {
+	ids := benchNetwork(b)
+	random := rand.New(rand.NewSource(1))
+	reader := func() string { return ids[benchCelebrities+random.Intn(len(ids)-benchCelebrities)] }
+
+	b.Run("first", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := read(reader(), nil, defaultFeedLimit); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("third", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			user, cursor := reader(), (*FeedCursor)(nil)
+			for n := 0; n < 3; n++ {
+				page, err := read(user, cursor, defaultFeedLimit)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if cursor, err = decodeFeedCursor(page.NextCursor); err != nil || cursor == nil {
+					break
+				}
+			}
+		}
+	})
+	b.Run("write", func(b *testing.B) {
+		author := reader()
+		for i := 0; i < b.N; i++ {
+			post := &Post{ID: uuid.New().String(), Content: "bench", Timestamp: time.Now(), UserID: author}
+			if err := write(post); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPullFeed(b *testing.B) {
+	benchFeed(b, pullFeed, func(post *Post) error {
+		return DB.Create(post).Error
+	})
+}
+
+func BenchmarkTimelineFeed(b *testing.B) {
+	benchFeed(b, timelineFeed, func(post *Post) error {
+		if err := DB.Create(post).Error; err != nil {
+			return err
+		}
+		return fanOut(DB, post)
+	})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	EventCreated  = "created"
+	EventUpdated  = "updated"
+	EventDeleted  = "deleted"
+	EventRestored = "restored"
+)
+
+// deleted tasks stay restorable this long
+const trashRetention = 30 * 24 * time.Hour
+
+// TaskEvent is one entry of the activity log, with the task as it was before
+// and after the change. Before is nil for creations, After for deletions.
+type TaskEvent struct {
+	ID       string    `json:"id"`
+	TaskID   string    `json:"task_id"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Before   *Task     `json:"before,omitempty"`
+	After    *Task     `json:"after,omitempty"`
+	At       time.Time `json:"at"`
+	UndoneBy string    `json:"undone_by,omitempty"` // event that reverted this one
+}
+
+// TrashedTask keeps a deleted task, who it was shared with and how it was
+// linked until it is restored or purged
+type TrashedTask struct {
+	Task      Task              `json:"task"`
+	DeletedAt time.Time         `json:"deleted_at"`
+	DeletedBy string            `json:"deleted_by"`
+	PurgeAt   time.Time         `json:"purge_at"`
+	Shares    map[string]string `json:"-"`
+	Blocks    []string          `json:"-"` // tasks that had this one in blocked_by
+	Children  []string          `json:"-"` // subtasks deleted along with it
+}
+
+var (
+	events     = make(map[string]TaskEvent)
+	taskEvents = make(map[string][]string) // task id -> event ids, oldest first
+	trash      = make(map[string]TrashedTask)
+)
+
+var (
+	errEventNotFound = errors.New("event not found")
+	errAlreadyUndone = errors.New("this change was already undone")
+	errTaskChanged   = errors.New("task changed after this event, undo the later changes first")
+	errTrashExpired  = errors.New("task is no longer in the trash")
+	errTrashedParent = errors.New("task was deleted with its parent task, restore the parent instead")
+)
+
+func cloneTask(task Task) *Task {
+	task.BlockedBy = append([]string(nil), task.BlockedBy...)
+	task.History = append([]StatusChange(nil), task.History...)
+	task.Labels = append([]string(nil), task.Labels...)
+	return &task
+}
+
+// recordEvent adds an entry to the activity log, caller must hold the mutex
+func recordEvent(actor, action string, before, after *Task) TaskEvent {
+	event := TaskEvent{ID: uuid.New().String(), Actor: actor, Action: action, At: time.Now()}
+	if before != nil {
+		event.Before = cloneTask(*before)
+		event.TaskID = before.ID
+	}
+	if after != nil {
+		event.After = cloneTask(*after)
+		event.TaskID = after.ID
+	}
+	events[event.ID] = event
+	taskEvents[event.TaskID] = append(taskEvents[event.TaskID], event.ID)
+	return event
+}
+
+// updateStored saves a changed task and logs the change against the stored
+// copy, caller must hold the mutex
+func updateStored(actor string, task *Task) TaskEvent {
+	before := tasks[task.ID]
+	touch(task)
+	tasks[task.ID] = *task
+	return recordEvent(actor, EventUpdated, &before, task)
+}
+
+// insertStored adds a new task to both indexes and logs it
+func insertStored(actor string, task Task) TaskEvent {
+	tasks[task.ID] = task
+	userTasks[task.Username] = append(userTasks[task.Username], task.ID)
+	return recordEvent(actor, EventCreated, nil, &task)
+}
+
+// trashedTree collects a trashed task and the subtasks deleted with it that
+// are still in the trash, parents first
+func trashedTree(taskID string) []TrashedTask {
+	trashed, ok := trash[taskID]
+	if !ok {
+		return nil
+	}
+	tree := []TrashedTask{trashed}
+	for _, childID := range trashed.Children {
+		tree = append(tree, trashedTree(childID)...)
+	}
+	return tree
+}
+
+// restoreFromTrash puts a deleted task back together with the subtasks that
+// were deleted with it, and links them again to the tasks they blocked. Links
+// to tasks that are gone by now are dropped. A subtask deleted with its parent
+// only comes back with the parent, alone it would lose its place in the tree.
+// Caller must hold the mutex.
+func restoreFromTrash(actor, taskID string) (TaskEvent, error) {
+	purgeTrash(time.Now())
+	tree := trashedTree(taskID)
+	if len(tree) == 0 {
+		return TaskEvent{}, errTrashExpired
+	}
+	if parent, ok := trash[tree[0].Task.ParentID]; ok && contains(parent.Children, taskID) {
+		return TaskEvent{}, errTrashedParent
+	}
+
+	// put the whole tree back first so links inside it survive
+	for _, trashed := range tree {
+		delete(trash, trashed.Task.ID)
+		tasks[trashed.Task.ID] = trashed.Task
+		userTasks[trashed.Task.Username] = append(userTasks[trashed.Task.Username], trashed.Task.ID)
+		if len(trashed.Shares) > 0 {
+			taskShares[trashed.Task.ID] = trashed.Shares
+		}
+	}
+
+	var restored TaskEvent
+	for _, trashed := range tree {
+		task := tasks[trashed.Task.ID]
+		if _, exists := tasks[task.ParentID]; !exists {
+			task.ParentID = ""
+		}
+		var blockers []string
+		for _, id := range task.BlockedBy {
+			if _, exists := tasks[id]; exists {
+				blockers = append(blockers, id)
+			}
+		}
+		task.BlockedBy = blockers
+		touch(&task)
+		tasks[task.ID] = task
+
+		event := recordEvent(actor, EventRestored, nil, &task)
+		markRestored(task.ID, event.ID)
+		if task.ID == taskID {
+			restored = event
+		}
+
+		for _, id := range trashed.Blocks {
+			other, exists := tasks[id]
+			if !exists || contains(other.BlockedBy, task.ID) {
+				continue
+			}
+			other.BlockedBy = append(other.BlockedBy, task.ID)
+			updateStored(actor, &other)
+		}
+	}
+	return restored, nil
+}
+
+// markRestored sets UndoneBy on the deletion a restore reverted, so it can't
+// be undone a second time
+func markRestored(taskID, restoreID string) {
+	ids := taskEvents[taskID]
+	for i := len(ids) - 1; i >= 0; i-- {
+		event := events[ids[i]]
+		if event.Action == EventDeleted && event.UndoneBy == "" {
+			event.UndoneBy = restoreID
+			events[event.ID] = event
+			return
+		}
+	}
+}
+
+// purgeTrash drops tasks that have been in the trash past the retention
+func purgeTrash(now time.Time) {
+	for id, trashed := range trash {
+		if now.After(trashed.PurgeAt) {
+			delete(trash, id)
+			forgetSeries(trashed.Task.SeriesID)
+		}
+	}
+}
+
+func purgeTrashLoop() {
+	for range time.Tick(time.Hour) {
+		mutex.Lock()
+		purgeTrash(time.Now())
+		mutex.Unlock()
+	}
+}
+
+// undoEvent reverts one change. It refuses when the task moved on since, so
+// an undo never silently throws away a later edit, and when the old state
+// breaks the workflow or the dependency graph. Caller must hold the mutex.
+func undoEvent(actor string, event TaskEvent) (TaskEvent, error) {
+	if event.UndoneBy != "" {
+		return TaskEvent{}, errAlreadyUndone
+	}
+
+	var undo TaskEvent
+	switch event.Action {
+	case EventCreated, EventRestored:
+		current, exists := tasks[event.TaskID]
+		if !exists {
+			return TaskEvent{}, errTaskNotFound
+		}
+		if roleFor(actor, current) != RoleOwner {
+			return TaskEvent{}, errOwnerOnly
+		}
+		if current.Version != event.After.Version {
+			return TaskEvent{}, errTaskChanged
+		}
+		if len(childrenOf(current.ID)) > 0 {
+			return TaskEvent{}, errors.New("task has subtasks now, delete it explicitly")
+		}
+		undo = removeTask(actor, current)
+
+	case EventUpdated:
+		current, exists := tasks[event.TaskID]
+		if !exists {
+			return TaskEvent{}, errTaskNotFound
+		}
+		if roleRank[roleFor(actor, current)] < roleRank[RoleEditor] {
+			return TaskEvent{}, errTaskNotFound
+		}
+		if current.Version != event.After.Version {
+			return TaskEvent{}, errTaskChanged
+		}
+
+		restored := cloneTask(*event.Before)
+		restored.Version = current.Version
+		if _, exists := tasks[restored.ParentID]; !exists {
+			restored.ParentID = ""
+		}
+		var blockers []string
+		for _, id := range restored.BlockedBy {
+			if _, exists := tasks[id]; exists {
+				blockers = append(blockers, id)
+			}
+		}
+		restored.BlockedBy = blockers
+		// the old state has to be valid now, blockers may have changed since
+		if restored.Status != current.Status {
+			if err := checkTransition(current.Status, restored.Status); err != nil {
+				return TaskEvent{}, err
+			}
+		}
+		if err := validateRelations(restored, current.Username); err != nil {
+			return TaskEvent{}, err
+		}
+		undo = updateStored(actor, restored)
+
+	case EventDeleted:
+		trashed, ok := trash[event.TaskID]
+		if !ok {
+			return TaskEvent{}, errTrashExpired
+		}
+		if trashed.Task.Username != actor {
+			return TaskEvent{}, errOwnerOnly
+		}
+		var err error
+		if undo, err = restoreFromTrash(actor, event.TaskID); err != nil {
+			return TaskEvent{}, err
+		}
+	}
+
+	event.UndoneBy = undo.ID
+	events[event.ID] = event
+	return undo, nil
+}
+
+func undo(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	event, exists := events[c.Params("eventId")]
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": errEventNotFound.Error()})
+	}
+
+	undoneBy, err := undoEvent(username, event)
+	switch err {
+	case nil:
+		return c.JSON(undoneBy)
+	case errAlreadyUndone, errTaskChanged:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	case errTrashExpired:
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": err.Error()})
+	case errTaskNotFound, errOwnerOnly:
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+}
+
+// getTaskActivity lists the events of a task, newest first. The owner can
+// still read it after the task went to the trash.
+func getTaskActivity(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, err := accessTask(username, taskID, RoleViewer); err != nil {
+		trashed, inTrash := trash[taskID]
+		if !inTrash || trashed.Task.Username != username {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	ids := taskEvents[taskID]
+	result := make([]TaskEvent, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		result = append(result, events[ids[i]])
+	}
+
+	return c.JSON(result)
+}
+
+func getTrash(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	purgeTrash(time.Now())
+	result := []TrashedTask{}
+	for _, trashed := range trash {
+		if trashed.Task.Username == username {
+			result = append(result, trashed)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DeletedAt.After(result[j].DeletedAt) })
+
+	return c.JSON(result)
+}
+
+func restoreTask(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if trashed, ok := trash[taskID]; !ok || trashed.Task.Username != username {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "task not found in trash"})
+	}
+	event, err := restoreFromTrash(username, taskID)
+	if err == errTrashedParent {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(event.After)
+}
+
+// purgeTask deletes a task from the trash for good
+func purgeTask(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	trashed, ok := trash[taskID]
+	if !ok || trashed.Task.Username != username {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "task not found in trash"})
+	}
+	delete(trash, taskID)
+	forgetSeries(trashed.Task.SeriesID)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
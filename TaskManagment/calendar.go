@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// calendar feed tokens are secrets in the subscription URL, calendar apps
+// can't send our JWT so the token is the only thing protecting the feed
+var (
+	calendarTokens     = make(map[string]string) // token -> username
+	userCalendarTokens = make(map[string]string) // username -> token
+)
+
+const icsTimeFormat = "20060102T150405Z"
+
+func newCalendarToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func calendarURL(c *fiber.Ctx, token string) string {
+	return c.BaseURL() + "/calendar/" + token + ".ics"
+}
+
+// createCalendarToken issues a feed URL, any previous URL stops working
+func createCalendarToken(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	token, err := newCalendarToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not create token"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if old, ok := userCalendarTokens[username]; ok {
+		delete(calendarTokens, old)
+	}
+	calendarTokens[token] = username
+	userCalendarTokens[username] = token
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"token": token, "url": calendarURL(c, token)})
+}
+
+func getCalendarToken(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	token, ok := userCalendarTokens[username]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no calendar feed, create one first"})
+	}
+
+	return c.JSON(fiber.Map{"token": token, "url": calendarURL(c, token)})
+}
+
+func revokeCalendarToken(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	token, ok := userCalendarTokens[username]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no calendar feed to revoke"})
+	}
+	delete(calendarTokens, token)
+	delete(userCalendarTokens, username)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// calendarFeed serves the open tasks with a due date as an RFC 5545 calendar.
+// Tasks come out as VEVENTs, which every calendar app shows, or as VTODOs
+// with ?type=todo. The feed is built on every request so it is always current.
+func calendarFeed(c *fiber.Ctx) error {
+	component := "VEVENT"
+	switch c.Query("type", "event") {
+	case "event":
+	case "todo":
+		component = "VTODO"
+	default:
+		return c.Status(fiber.StatusBadRequest).SendString("type must be event or todo")
+	}
+
+	mutex.Lock()
+	username, ok := calendarTokens[c.Params("token")]
+	var feedTasks []Task
+	if ok {
+		for _, task := range visibleTasks(username) {
+			if isOpen(task) && !task.DueDate.IsZero() {
+				feedTasks = append(feedTasks, task)
+			}
+		}
+	}
+	mutex.Unlock()
+
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("calendar not found")
+	}
+
+	sort.Slice(feedTasks, func(i, j int) bool { return feedTasks[i].DueDate.Before(feedTasks[j].DueDate) })
+
+	c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.SendString(buildCalendar(username, component, feedTasks, time.Now()))
+}
+
+func buildCalendar(username, component string, feedTasks []Task, now time.Time) string {
+	var b strings.Builder
+	line := func(name, value string) {
+		b.WriteString(foldICSLine(name + ":" + value))
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//TaskManagment//Tasks//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	line("X-WR-CALNAME", escapeICSText("Tasks for "+username))
+	line("REFRESH-INTERVAL;VALUE=DURATION", "PT15M")
+	line("X-PUBLISHED-TTL", "PT15M")
+
+	for _, task := range feedTasks {
+		stamp := task.UpdatedAt
+		if stamp.IsZero() {
+			stamp = now
+		}
+
+		line("BEGIN", component)
+		line("UID", task.ID+"@taskmanagment")
+		line("DTSTAMP", stamp.UTC().Format(icsTimeFormat))
+		line("CREATED", task.CreatedAt.UTC().Format(icsTimeFormat))
+		line("LAST-MODIFIED", stamp.UTC().Format(icsTimeFormat))
+		line("SUMMARY", escapeICSText(task.Title))
+		if task.Description != "" {
+			line("DESCRIPTION", escapeICSText(task.Description))
+		}
+		if task.List != "" {
+			line("CATEGORIES", escapeICSText(task.List))
+		}
+
+		due := task.DueDate.UTC().Format(icsTimeFormat)
+		if component == "VTODO" {
+			line("DUE", due)
+			if task.Status == StatusInProgress {
+				line("STATUS", "IN-PROCESS")
+			} else {
+				line("STATUS", "NEEDS-ACTION")
+			}
+		} else {
+			line("DTSTART", due)
+			line("TRANSP", "TRANSPARENT")
+		}
+		line("END", component)
+	}
+
+	line("END", "VCALENDAR")
+	return b.String()
+}
+
+// escapeICSText escapes a TEXT value as in RFC 5545 section 3.3.11
+func escapeICSText(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, ";", "\\;")
+	value = strings.ReplaceAll(value, ",", "\\,")
+	value = strings.ReplaceAll(value, "\r\n", "\\n")
+	value = strings.ReplaceAll(value, "\n", "\\n")
+	value = strings.ReplaceAll(value, "\r", "\\n")
+	return value
+}
+
+// foldICSLine ends a content line with CRLF and folds it so no line is over
+// 75 octets, without splitting a UTF-8 character
+func foldICSLine(content string) string {
+	var b strings.Builder
+	limit := 75
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		b.WriteString(content[:cut])
+		b.WriteString("\r\n ")
+		content = content[cut:]
+		limit = 74 // the leading space counts towards the next line
+	}
+	b.WriteString(content)
+	b.WriteString("\r\n")
+	return b.String()
+}
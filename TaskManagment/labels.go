@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	PriorityNone   = ""
+	PriorityLow    = "low"
+	PriorityMedium = "medium"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+var priorityRank = map[string]int{
+	PriorityNone:   0,
+	PriorityLow:    1,
+	PriorityMedium: 2,
+	PriorityHigh:   3,
+	PriorityUrgent: 4,
+}
+
+type Label struct {
+	Name  string `json:"name"`
+	Color string `json:"color"` // #rrggbb
+}
+
+// labels are per user, tasks can only use labels their owner has defined
+var labels = make(map[string]map[string]Label) // username -> name -> label
+
+var labelColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+const defaultLabelColor = "#808080"
+
+func normalizeLabel(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// validateLabels checks the priority and labels of a task against its owner's
+// labels, caller must hold the mutex
+func validateLabels(task *Task) error {
+	return validateLabelsWith(task, nil)
+}
+
+// validateLabelsWith is validateLabels that also accepts the labels in
+// pending, which the caller creates right before the task is saved
+func validateLabelsWith(task *Task, pending []string) error {
+	task.Priority = strings.ToLower(strings.TrimSpace(task.Priority))
+	if _, ok := priorityRank[task.Priority]; !ok {
+		return errors.New("priority must be low, medium, high or urgent")
+	}
+
+	seen := make(map[string]bool)
+	var result []string
+	for _, name := range task.Labels {
+		name = normalizeLabel(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if _, ok := labels[task.Username][name]; !ok && !contains(pending, name) {
+			return errors.New("unknown label " + name + ", create it first")
+		}
+		result = append(result, name)
+	}
+	task.Labels = result
+	return nil
+}
+
+func hasLabel(task Task, name string) bool {
+	for _, label := range task.Labels {
+		if label == name {
+			return true
+		}
+	}
+	return false
+}
+
+func createLabel(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	label := new(Label)
+	if err := c.BodyParser(label); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	label.Name = normalizeLabel(label.Name)
+	if label.Name == "" || strings.ContainsAny(label.Name, " \t()\"") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "label name is required and cannot contain spaces, quotes or parentheses"})
+	}
+	if label.Color == "" {
+		label.Color = defaultLabelColor
+	}
+	if !labelColor.MatchString(label.Color) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "color must look like #ff8800"})
+	}
+	label.Color = strings.ToLower(label.Color)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if labels[username] == nil {
+		labels[username] = make(map[string]Label)
+	}
+	labels[username][label.Name] = *label
+
+	return c.Status(fiber.StatusCreated).JSON(label)
+}
+
+func getLabels(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	result := []Label{}
+	for _, label := range labels[username] {
+		result = append(result, label)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return c.JSON(result)
+}
+
+// deleteLabel removes a label and takes it off every task that used it
+func deleteLabel(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	name := normalizeLabel(c.Params("name"))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := labels[username][name]; !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "label not found"})
+	}
+	delete(labels[username], name)
+
+	for _, taskID := range userTasks[username] {
+		task := tasks[taskID]
+		if !hasLabel(task, name) {
+			continue
+		}
+		var remaining []string
+		for _, label := range task.Labels {
+			if label != name {
+				remaining = append(remaining, label)
+			}
+		}
+		task.Labels = remaining
+		updateStored(username, &task)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -17,12 +17,24 @@ type User struct {
 }
 
 type Task struct {
-	ID          string    `json:"id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Status      string    `json:"status"`
-	DueDate     time.Time `json:"due_date"`
-	Username    string    `json:"username"`
+	ID          string         `json:"id"`
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Status      string         `json:"status"` // see workflow.go for the allowed values and moves
+	DueDate     time.Time      `json:"due_date"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	Version     int            `json:"version"` // bumped on every change, sent as the ETag
+	Username    string         `json:"username"`
+	RRule       string         `json:"rrule,omitempty"`      // RFC 5545 recurrence rule, e.g. FREQ=WEEKLY;BYDAY=MO,TH
+	SeriesID    string         `json:"series_id,omitempty"`  // set on every occurrence of a recurring task
+	Occurrence  int            `json:"occurrence,omitempty"` // 1 for the first occurrence of a series
+	ParentID    string         `json:"parent_id,omitempty"`  // set on subtasks
+	BlockedBy   []string       `json:"blocked_by,omitempty"` // tasks that have to be done before this one
+	History     []StatusChange `json:"history,omitempty"`
+	List        string         `json:"list,omitempty"` // list the task is filed under, lists can be shared
+	Labels      []string       `json:"labels,omitempty"`
+	Priority    string         `json:"priority,omitempty"` // low, medium, high or urgent
 }
 
 var (
@@ -34,7 +46,10 @@ var (
 )
 
 func main() {
-	app := fiber.New()
+	// Immutable because params and body values end up as map keys and task fields
+	app := fiber.New(fiber.Config{Immutable: true})
+
+	go purgeTrashLoop()
 
 	// Middleware
 	app.Use(logger.New())
@@ -42,18 +57,58 @@ func main() {
 	// Public routes
 	app.Post("/register", register)
 	app.Post("/login", login)
+	app.Get("/calendar/:token.ics", calendarFeed) // secret token instead of JWT, for calendar apps
 
 	// Restricted routes
 	api := app.Group("/api", jwtMiddleware)
 
 	api.Post("/tasks", createTask)
+	api.Post("/tasks/quick", quickAddTask)
 	api.Get("/tasks", getTasks)
 	api.Put("/tasks/:id", updateTask)
+	api.Patch("/tasks/:id", patchTask)
+	api.Get("/tasks/:id", getTask)
 	api.Delete("/tasks/:id", deleteTask)
+	api.Get("/tasks/:id/upcoming", upcomingOccurrences)
+	api.Get("/tasks/:id/progress", getTaskProgress)
+	api.Get("/tasks/:id/history", getTaskHistory)
+	api.Get("/tasks/:id/activity", getTaskActivity)
+	api.Post("/tasks/:id/blockers", addBlocker)
+	api.Delete("/tasks/:id/blockers/:blockerId", removeBlocker)
+	api.Get("/recurrence/preview", previewRecurrence)
+	api.Post("/undo/:eventId", undo)
+	api.Get("/trash", getTrash)
+	api.Post("/trash/:id/restore", restoreTask)
+	api.Delete("/trash/:id", purgeTask)
+
+	api.Get("/tasks/:id/shares", getTaskShares)
+	api.Post("/tasks/:id/shares", shareTask)
+	api.Delete("/tasks/:id/shares/:username", unshareTask)
+	api.Get("/lists/:list/shares", getListShares)
+	api.Post("/lists/:list/shares", shareList)
+	api.Delete("/lists/:list/shares/:username", unshareList)
+
+	api.Get("/labels", getLabels)
+	api.Post("/labels", createLabel)
+	api.Delete("/labels/:name", deleteLabel)
+	api.Get("/views", getViews)
+	api.Post("/views", createView)
+	api.Delete("/views/:id", deleteView)
+	api.Get("/views/:id/tasks", runView)
+
+	api.Get("/calendar/token", getCalendarToken)
+	api.Post("/calendar/token", createCalendarToken)
+	api.Delete("/calendar/token", revokeCalendarToken)
 
 	log.Fatal(app.Listen(":3000"))
 }
 
+// touch marks a task as changed, call it before storing a modified task
+func touch(task *Task) {
+	task.UpdatedAt = time.Now()
+	task.Version++
+}
+
 func jwtMiddleware(c *fiber.Ctx) error {
 	authHeader := c.Get("Authorization")
 	if authHeader == "" {
@@ -134,29 +189,59 @@ func createTask(c *fiber.Ctx) error {
 
 	task.ID = uuid.New().String()
 	task.Username = username
-	tasks[task.ID] = *task
-	userTasks[username] = append(userTasks[username], task.ID)
+	task.CreatedAt = time.Now()
+	task.UpdatedAt = task.CreatedAt
+	task.Version = 1
+	task.SeriesID = ""
+	task.Occurrence = 0
+	if task.Status == "" {
+		task.Status = StatusTodo
+	}
+	if err := checkTransition("", task.Status); err != nil {
+		return transitionErrorResponse(c, err)
+	}
+	task.History = nil
+	recordStatus(task, "", task.CreatedAt)
+	if err := validateRelations(task, username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := validateLabels(task); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if task.RRule != "" {
+		if err := startSeries(task); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	insertStored(username, *task)
 
+	setETag(c, *task)
 	return c.Status(fiber.StatusCreated).JSON(task)
 }
 
 func getTasks(c *fiber.Ctx) error {
 	username := c.Locals("user").(string)
 
+	query, err := parseTaskQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	var result []Task
-	for _, taskID := range userTasks[username] {
-		result = append(result, tasks[taskID])
-	}
-
-	return c.JSON(result)
+	return c.JSON(query.run(visibleTasks(username)))
 }
 
+// updateTask replaces a task. For recurring tasks ?scope=this (default) edits
+// only this occurrence and ?scope=future edits this and all later ones.
 func updateTask(c *fiber.Ctx) error {
 	username := c.Locals("user").(string)
 	taskID := c.Params("id")
+	scope := c.Query("scope", "this")
+	if scope != "this" && scope != "future" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "scope must be this or future"})
+	}
 	task := new(Task)
 	if err := c.BodyParser(task); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
@@ -165,36 +250,94 @@ func updateTask(c *fiber.Ctx) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	storedTask, exists := tasks[taskID]
-	if !exists || storedTask.Username != username {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "task not found or unauthorized access"})
+	storedTask, err := accessTask(username, taskID, RoleEditor)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !ifMatch(c, storedTask) {
+		return preconditionFailed(c, storedTask)
 	}
 
-	task.ID = taskID
-	task.Username = username
-	tasks[taskID] = *task
+	return saveTaskUpdate(c, username, storedTask, task, scope)
+}
+
+// saveTaskUpdate validates and stores the new state of a task for PUT and
+// PATCH, caller must hold the mutex
+func saveTaskUpdate(c *fiber.Ctx, username string, storedTask Task, task *Task, scope string) error {
+	if task.List != storedTask.List && storedTask.Username != username {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only the owner can move a task to another list"})
+	}
+
+	task.ID = storedTask.ID
+	task.Username = storedTask.Username
+	task.CreatedAt = storedTask.CreatedAt
+	task.Version = storedTask.Version
+	task.SeriesID = storedTask.SeriesID
+	task.Occurrence = storedTask.Occurrence
+	task.History = storedTask.History
+	if task.Status != storedTask.Status {
+		if err := checkTransition(storedTask.Status, task.Status); err != nil {
+			return transitionErrorResponse(c, err)
+		}
+		recordStatus(task, storedTask.Status, time.Now())
+	}
+	if err := validateRelations(task, task.Username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := validateLabels(task); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if task.Status == StatusDone && storedTask.Status != StatusDone && len(openBlockers(*task)) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": errOpenBlockers.Error(), "blocked_by": openBlockers(*task)})
+	}
+	if err := applySeriesEdit(username, storedTask, task, scope); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	updateStored(username, task)
+
+	if task.Status == StatusDone && storedTask.Status != StatusDone && task.SeriesID != "" {
+		spawnNextOccurrence(username, *task)
+	}
 
+	setETag(c, *task)
 	return c.JSON(task)
 }
 
+// deleteTask removes a task. A task with subtasks needs ?children=cascade to
+// delete them too, or ?children=reparent to move them up to its own parent.
 func deleteTask(c *fiber.Ctx) error {
 	username := c.Locals("user").(string)
 	taskID := c.Params("id")
+	children := c.Query("children")
+	if children != "" && children != "cascade" && children != "reparent" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "children must be cascade or reparent"})
+	}
 
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	storedTask, exists := tasks[taskID]
-	if !exists || storedTask.Username != username {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "task not found or unauthorized access"})
+	storedTask, err := accessTask(username, taskID, RoleOwner)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !ifMatch(c, storedTask) {
+		return preconditionFailed(c, storedTask)
 	}
 
-	delete(tasks, taskID)
-	for i, id := range userTasks[username] {
-		if id == taskID {
-			userTasks[username] = append(userTasks[username][:i], userTasks[username][i+1:]...)
-			break
+	subtasks := childrenOf(taskID)
+	switch {
+	case len(subtasks) == 0:
+		removeTask(username, storedTask)
+	case children == "cascade":
+		removeTaskTree(username, storedTask)
+	case children == "reparent":
+		for _, child := range subtasks {
+			child.ParentID = storedTask.ParentID
+			updateStored(username, &child)
 		}
+		removeTask(username, storedTask)
+	default:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "task has subtasks, pass children=cascade or children=reparent"})
 	}
 
 	return c.SendStatus(fiber.StatusNoContent)
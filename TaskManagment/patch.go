@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json" // RFC 7396
+	jsonPatchContentType  = "application/json-patch+json"  // RFC 6902
+)
+
+// errPatchTestFailed is returned when a JSON Patch "test" operation doesn't match
+var errPatchTestFailed = errors.New("patch test operation failed")
+
+func etag(task Task) string {
+	return `"` + strconv.Itoa(task.Version) + `"`
+}
+
+func setETag(c *fiber.Ctx, task Task) {
+	c.Set(fiber.HeaderETag, etag(task))
+}
+
+// ifMatch checks the If-Match header against the stored task. Without the
+// header the write goes through, clients opt in to the conflict check.
+func ifMatch(c *fiber.Ctx, task Task) bool {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag(task) {
+			return true
+		}
+	}
+	return false
+}
+
+func preconditionFailed(c *fiber.Ctx, task Task) error {
+	setETag(c, task)
+	return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+		"error":   "task was changed by someone else, reload it and try again",
+		"version": task.Version,
+	})
+}
+
+// patchTask applies a JSON Merge Patch or a JSON Patch to a task, picked by
+// Content-Type. Fields left out of the patch keep their stored values.
+func patchTask(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+	scope := c.Query("scope", "this")
+	if scope != "this" && scope != "future" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "scope must be this or future"})
+	}
+
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(c.Get(fiber.HeaderContentType), ";")[0]))
+	if contentType != mergePatchContentType && contentType != jsonPatchContentType && contentType != fiber.MIMEApplicationJSON {
+		c.Set("Accept-Patch", mergePatchContentType+", "+jsonPatchContentType)
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": "use " + mergePatchContentType + " or " + jsonPatchContentType})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	storedTask, err := accessTask(username, taskID, RoleEditor)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !ifMatch(c, storedTask) {
+		return preconditionFailed(c, storedTask)
+	}
+
+	task, err := applyTaskPatch(storedTask, contentType, c.Body())
+	if errors.Is(err, errPatchTestFailed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return saveTaskUpdate(c, username, storedTask, task, scope)
+}
+
+// applyTaskPatch runs the patch against the task's JSON form and reads the
+// result back. Plain application/json is treated as a merge patch.
+func applyTaskPatch(stored Task, contentType string, body []byte) (*Task, error) {
+	raw, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	if contentType == jsonPatchContentType {
+		var ops []patchOperation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, errors.New("JSON Patch body must be an array of operations")
+		}
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			return nil, err
+		}
+	} else {
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return nil, errors.New("cannot parse JSON")
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return nil, errors.New("merge patch must be a JSON object")
+		}
+		doc = mergePatch(doc, patch)
+	}
+
+	patched, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	task := new(Task)
+	if err := json.Unmarshal(patched, task); err != nil {
+		return nil, fmt.Errorf("patched task is invalid: %v", err)
+	}
+	return task, nil
+}
+
+// mergePatch implements RFC 7396: objects merge key by key, null deletes a key
+// and anything else replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch implements RFC 6902. Operations run in order and the first
+// failing one aborts the whole patch.
+func applyJSONPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, fmt.Errorf("operation %d: path is required", i)
+		}
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+
+		var value interface{}
+		if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d: value is required for %s", i, op.Op)
+			}
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, fmt.Errorf("operation %d: invalid value", i)
+			}
+		}
+
+		var from []string
+		if op.Op == "move" || op.Op == "copy" {
+			if op.From == nil {
+				return nil, fmt.Errorf("operation %d: from is required for %s", i, op.Op)
+			}
+			if from, err = parsePointer(*op.From); err != nil {
+				return nil, fmt.Errorf("operation %d: %v", i, err)
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, path, value)
+		case "remove":
+			doc, err = pointerRemove(doc, path)
+		case "replace":
+			if doc, err = pointerRemove(doc, path); err == nil {
+				doc, err = pointerAdd(doc, path, value)
+			}
+		case "move":
+			if isPrefix(from, path) && len(from) < len(path) {
+				return nil, fmt.Errorf("operation %d: cannot move a value into itself", i)
+			}
+			var moved interface{}
+			if moved, err = pointerGet(doc, from); err == nil {
+				if doc, err = pointerRemove(doc, from); err == nil {
+					doc, err = pointerAdd(doc, path, moved)
+				}
+			}
+		case "copy":
+			var copied interface{}
+			if copied, err = pointerGet(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, deepCopy(copied))
+			}
+		case "test":
+			var current interface{}
+			if current, err = pointerGet(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+				return nil, fmt.Errorf("operation %d: %w at %s", i, errPatchTestFailed, *op.Path)
+			}
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array index token, end allows the "-" past-the-end token
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	limit := length - 1
+	if end {
+		limit = length
+	}
+	if index > limit {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path member %q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("cannot walk into %q", token)
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate walks to the parent of the last token and lets fn rebuild it.
+// Arrays can change length, so every level hands its new value back up.
+func pointerUpdate(doc interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	child, err := pointerGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	newChild, err := pointerUpdate(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = newChild
+	case []interface{}:
+		index, _ := arrayIndex(path[0], len(node), false)
+		node[index] = newChild
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a value that is not an object or array", token)
+	})
+}
+
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole task")
+	}
+	return pointerUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, fmt.Errorf("path member %q does not exist", token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:index:index], node[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q from a value that is not an object or array", token)
+	})
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = deepCopy(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = deepCopy(item)
+		}
+		return result
+	}
+	return value
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// TaskQuery holds the filters, ordering and page window for GET /api/tasks
+type TaskQuery struct {
+	Statuses []string
+	List     string
+	DueFrom  time.Time
+	DueTo    time.Time
+	Search   []string
+	Sort     string // due_date, created_at or title
+	Desc     bool
+	Limit    int
+	After    *taskCursor
+
+	Predicate func(Task) bool // extra filter, used by smart views
+}
+
+// TaskPage is what getTasks sends back
+type TaskPage struct {
+	Tasks           []Task `json:"tasks"`
+	Total           int    `json:"total"`            // tasks matching the filters
+	UnfilteredTotal int    `json:"unfiltered_total"` // tasks before any filter
+	NextCursor      string `json:"next_cursor,omitempty"`
+}
+
+// taskCursor remembers the sort key and id of the last task on a page, so the
+// next page starts right after it even if tasks were added or removed meanwhile
+type taskCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d"`
+	Key  string `json:"k"`
+	ID   string `json:"i"`
+}
+
+func parseTaskQuery(c *fiber.Ctx) (*TaskQuery, error) {
+	query := &TaskQuery{Sort: "created_at", Limit: defaultPageSize}
+
+	if raw := c.Query("status"); raw != "" {
+		for _, status := range strings.Split(raw, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				query.Statuses = append(query.Statuses, status)
+			}
+		}
+	}
+
+	query.List = c.Query("list")
+
+	var err error
+	if query.DueFrom, err = parseQueryTime(c.Query("due_from"), false); err != nil {
+		return nil, errors.New("invalid due_from, use RFC 3339 or YYYY-MM-DD")
+	}
+	if query.DueTo, err = parseQueryTime(c.Query("due_to"), true); err != nil {
+		return nil, errors.New("invalid due_to, use RFC 3339 or YYYY-MM-DD")
+	}
+
+	query.Search = strings.Fields(strings.ToLower(c.Query("q")))
+
+	if sortBy := c.Query("sort"); sortBy != "" {
+		switch sortBy {
+		case "due_date", "created_at", "title":
+			query.Sort = sortBy
+		default:
+			return nil, errors.New("sort must be one of due_date, created_at, title")
+		}
+	}
+
+	switch c.Query("order", "asc") {
+	case "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return nil, errors.New("limit must be a positive number")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		query.Limit = limit
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Sort != query.Sort || cursor.Desc != query.Desc {
+			return nil, errors.New("cursor was issued for a different sort order")
+		}
+		query.After = cursor
+	}
+
+	return query, nil
+}
+
+// parseQueryTime accepts RFC 3339 or a plain date; a plain date used as an
+// upper bound covers the whole day
+func parseQueryTime(raw string, endOfDay bool) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+func (q *TaskQuery) matches(task Task) bool {
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, status := range q.Statuses {
+			if task.Status == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.List != "" && task.List != q.List {
+		return false
+	}
+
+	if !q.DueFrom.IsZero() || !q.DueTo.IsZero() {
+		if task.DueDate.IsZero() {
+			return false
+		}
+		if !q.DueFrom.IsZero() && task.DueDate.Before(q.DueFrom) {
+			return false
+		}
+		if !q.DueTo.IsZero() && task.DueDate.After(q.DueTo) {
+			return false
+		}
+	}
+
+	if q.Predicate != nil && !q.Predicate(task) {
+		return false
+	}
+
+	if len(q.Search) > 0 {
+		text := strings.ToLower(task.Title + " " + task.Description)
+		for _, word := range q.Search {
+			if !strings.Contains(text, word) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// less orders tasks by the chosen key and falls back to the id so that every
+// task has a fixed position, which is what makes the cursor stable
+func (q *TaskQuery) less(a, b Task) bool {
+	var cmp int
+	switch q.Sort {
+	case "due_date":
+		// tasks without a due date always go last
+		switch {
+		case a.DueDate.IsZero() && b.DueDate.IsZero():
+		case a.DueDate.IsZero():
+			return false
+		case b.DueDate.IsZero():
+			return true
+		default:
+			cmp = a.DueDate.Compare(b.DueDate)
+		}
+	case "title":
+		cmp = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	default:
+		cmp = a.CreatedAt.Compare(b.CreatedAt)
+	}
+
+	if cmp == 0 {
+		cmp = strings.Compare(a.ID, b.ID)
+	}
+	if q.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (q *TaskQuery) run(all []Task) TaskPage {
+	matched := []Task{}
+	for _, task := range all {
+		if q.matches(task) {
+			matched = append(matched, task)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return q.less(matched[i], matched[j]) })
+
+	start := 0
+	if q.After != nil {
+		last := q.After.task()
+		start = sort.Search(len(matched), func(i int) bool { return q.less(last, matched[i]) })
+	}
+
+	end := start + q.Limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := TaskPage{
+		Tasks:           matched[start:end],
+		Total:           len(matched),
+		UnfilteredTotal: len(all),
+	}
+	if end < len(matched) {
+		page.NextCursor = q.cursorFor(matched[end-1])
+	}
+	return page
+}
+
+func (q *TaskQuery) cursorFor(task Task) string {
+	cursor := taskCursor{Sort: q.Sort, Desc: q.Desc, ID: task.ID}
+	switch q.Sort {
+	case "due_date":
+		if !task.DueDate.IsZero() {
+			cursor.Key = task.DueDate.Format(time.RFC3339Nano)
+		}
+	case "title":
+		cursor.Key = task.Title
+	default:
+		cursor.Key = task.CreatedAt.Format(time.RFC3339Nano)
+	}
+
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(raw string) (*taskCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	cursor := new(taskCursor)
+	if err := json.Unmarshal(data, cursor); err != nil || cursor.ID == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	if cursor.Key != "" && cursor.Sort != "title" {
+		if _, err := time.Parse(time.RFC3339Nano, cursor.Key); err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+	}
+	return cursor, nil
+}
+
+// task rebuilds just enough of the last seen task to compare against
+func (cur *taskCursor) task() Task {
+	task := Task{ID: cur.ID}
+	switch cur.Sort {
+	case "due_date":
+		task.DueDate, _ = time.Parse(time.RFC3339Nano, cur.Key)
+	case "title":
+		task.Title = cur.Key
+	default:
+		task.CreatedAt, _ = time.Parse(time.RFC3339Nano, cur.Key)
+	}
+	return task
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// QuickAddRequest is a task written as one line of text, like
+// "Pay rent every month on the 1st at 9am #home !high"
+type QuickAddRequest struct {
+	Text string `json:"text"`
+	Now  string `json:"now"` // RFC 3339 reference time for relative dates, defaults to the server clock
+	TZ   string `json:"tz"`  // time zone dates and times are read in, defaults to UTC
+}
+
+// QuickAddPart is one piece of the text that was understood
+type QuickAddPart struct {
+	Kind  string `json:"kind"` // date, time, recurrence, label or priority
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// tasks given a date but no time are due at the end of that day
+const (
+	quickAddDefaultHour   = 23
+	quickAddDefaultMinute = 59
+)
+
+var (
+	quickMonths = map[string]time.Month{
+		"jan": time.January, "january": time.January, "feb": time.February, "february": time.February,
+		"mar": time.March, "march": time.March, "apr": time.April, "april": time.April,
+		"may": time.May, "jun": time.June, "june": time.June, "jul": time.July, "july": time.July,
+		"aug": time.August, "august": time.August, "sep": time.September, "sept": time.September,
+		"september": time.September, "oct": time.October, "october": time.October,
+		"nov": time.November, "november": time.November, "dec": time.December, "december": time.December,
+	}
+	quickWeekdays = map[string]time.Weekday{
+		"mon": time.Monday, "monday": time.Monday, "tue": time.Tuesday, "tues": time.Tuesday,
+		"tuesday": time.Tuesday, "wed": time.Wednesday, "wednesday": time.Wednesday,
+		"thu": time.Thursday, "thur": time.Thursday, "thurs": time.Thursday, "thursday": time.Thursday,
+		"fri": time.Friday, "friday": time.Friday, "sat": time.Saturday, "saturday": time.Saturday,
+		"sun": time.Sunday, "sunday": time.Sunday,
+	}
+	quickNumbers = map[string]int{
+		"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+		"seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+	}
+	quickOrdinals = map[string]int{
+		"first": 1, "second": 2, "third": 3, "fourth": 4, "fifth": 5, "last": -1,
+	}
+	quickPriorities = map[string]string{
+		"!low": PriorityLow, "!medium": PriorityMedium, "!high": PriorityHigh, "!urgent": PriorityUrgent,
+	}
+	// words that may introduce a date, dropped from the title along with it
+	quickConnectors = map[string]bool{"on": true, "by": true, "due": true, "from": true, "starting": true}
+
+	quickClock = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?(am|pm)?$`)
+	quickDay   = regexp.MustCompile(`^(\d{1,2})(st|nd|rd|th)?$`)
+)
+
+// quickParser reads a quick-add line word by word. Words that are part of
+// a date, time, recurrence, label or priority are marked used, the rest
+// make up the title.
+type quickParser struct {
+	words []string
+	norm  []string // lower case, trailing punctuation removed
+	used  []bool
+	now   time.Time
+
+	date     time.Time // midnight of the due day, zero when none was given
+	hasTime  bool
+	hour     int
+	minute   int
+	rule     *recurrenceRule
+	labels   []string
+	priority string
+	parts    []QuickAddPart
+}
+
+func parseQuickAdd(text string, now time.Time) (*quickParser, error) {
+	p := &quickParser{words: strings.Fields(text), now: now}
+	for _, word := range p.words {
+		p.norm = append(p.norm, strings.TrimRight(strings.ToLower(word), ",.;"))
+	}
+	p.used = make([]bool, len(p.words))
+
+	for i := 0; i < len(p.words); {
+		if n := p.match(i); n > 0 {
+			i += n
+		} else {
+			i++
+		}
+	}
+
+	if p.title() == "" {
+		return nil, errors.New("task needs a title besides its date, labels and priority")
+	}
+	if p.rule != nil && p.due().IsZero() {
+		return nil, errors.New("could not find a first date for the recurrence")
+	}
+	return p, nil
+}
+
+// at returns the normalized word i, or "" when it is out of range or taken
+func (p *quickParser) at(i int) string {
+	if i < 0 || i >= len(p.norm) || p.used[i] {
+		return ""
+	}
+	return p.norm[i]
+}
+
+func (p *quickParser) take(i, n int, kind, value string) int {
+	for j := i; j < i+n; j++ {
+		p.used[j] = true
+	}
+	p.parts = append(p.parts, QuickAddPart{Kind: kind, Text: strings.Join(p.words[i:i+n], " "), Value: value})
+	return n
+}
+
+// match tries every kind of part at word i and returns how many words it took
+func (p *quickParser) match(i int) int {
+	word := p.at(i)
+
+	if name := normalizeLabel(strings.TrimPrefix(word, "#")); strings.HasPrefix(word, "#") && name != "" && !strings.ContainsAny(name, "#()\"") {
+		if !contains(p.labels, name) {
+			p.labels = append(p.labels, name)
+		}
+		return p.take(i, 1, "label", name)
+	}
+	if priority, ok := quickPriorities[word]; ok && p.priority == "" {
+		p.priority = priority
+		return p.take(i, 1, "priority", priority)
+	}
+
+	start := i
+	if quickConnectors[word] {
+		start = i + 1
+	}
+	for _, from := range []int{i, start} {
+		if p.rule == nil {
+			if n, rule := p.matchRecurrence(from); n > 0 {
+				p.rule = rule
+				return p.take(i, from-i+n, "recurrence", rule.String())
+			}
+		}
+		if p.date.IsZero() {
+			if n, date := p.matchDate(from); n > 0 {
+				p.date = date
+				return p.take(i, from-i+n, "date", date.Format("2006-01-02"))
+			}
+		}
+	}
+	// the end of a recurrence can come after other parts, "daily at 8am for 10 times"
+	if p.rule != nil && p.rule.Count == 0 && p.rule.Until.IsZero() {
+		if n := p.matchRecurrenceEnd(i, p.rule); n > 0 {
+			return p.take(i, n, "recurrence", p.rule.String())
+		}
+	}
+	if !p.hasTime {
+		if n, hour, minute := p.matchTime(i); n > 0 {
+			p.hasTime, p.hour, p.minute = true, hour, minute
+			return p.take(i, n, "time", time.Date(2000, 1, 1, hour, minute, 0, 0, time.UTC).Format("15:04"))
+		}
+	}
+	return 0
+}
+
+func quickNumber(word string) (int, bool) {
+	if n, ok := quickNumbers[word]; ok {
+		return n, true
+	}
+	n, err := strconv.Atoi(word)
+	return n, err == nil && n > 0 && n < 1000
+}
+
+// quickDayOfMonth reads 5, 5th or 21st
+func quickDayOfMonth(word string) (int, bool) {
+	m := quickDay.FindStringSubmatch(word)
+	if m == nil {
+		return 0, false
+	}
+	day, _ := strconv.Atoi(m[1])
+	return day, day >= 1 && day <= 31
+}
+
+// quickOrdinal reads first, 2nd or last as used in "the 2nd tuesday"
+func quickOrdinal(word string) (int, bool) {
+	if n, ok := quickOrdinals[word]; ok {
+		return n, true
+	}
+	if m := quickDay.FindStringSubmatch(word); m != nil && m[2] != "" {
+		n, _ := strconv.Atoi(m[1])
+		return n, n >= 1 && n <= 5
+	}
+	return 0, false
+}
+
+// matchDate reads a due day starting at word i. A weekday on its own is the
+// next one after today, "next <weekday>" is that day in the following week.
+func (p *quickParser) matchDate(i int) (int, time.Time) {
+	today := startOfDay(p.now)
+	word := p.at(i)
+
+	switch word {
+	case "today":
+		return 1, today
+	case "tomorrow":
+		return 1, today.AddDate(0, 0, 1)
+	case "day":
+		if p.at(i+1) == "after" && p.at(i+2) == "tomorrow" {
+			return 3, today.AddDate(0, 0, 2)
+		}
+	case "in":
+		n, ok := quickNumber(p.at(i + 1))
+		if !ok {
+			break
+		}
+		switch strings.TrimSuffix(p.at(i+2), "s") {
+		case "day":
+			return 3, today.AddDate(0, 0, n)
+		case "week":
+			return 3, today.AddDate(0, 0, 7*n)
+		case "month":
+			return 3, today.AddDate(0, n, 0)
+		case "year":
+			return 3, today.AddDate(n, 0, 0)
+		}
+	case "next":
+		switch next := p.at(i + 1); next {
+		case "week":
+			return 2, weekStart(p.now).AddDate(0, 0, 7)
+		case "month":
+			return 2, monthStart(p.now).AddDate(0, 1, 0)
+		case "year":
+			return 2, time.Date(p.now.Year()+1, time.January, 1, 0, 0, 0, 0, p.now.Location())
+		default:
+			if weekday, ok := quickWeekdays[next]; ok {
+				return 2, weekStart(p.now).AddDate(0, 0, 7+(int(weekday)+6)%7)
+			}
+		}
+	}
+
+	if weekday, ok := quickWeekdays[word]; ok {
+		days := (int(weekday) - int(today.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		return 1, today.AddDate(0, 0, days)
+	}
+	if date, err := time.ParseInLocation("2006-01-02", word, p.now.Location()); err == nil {
+		return 1, date
+	}
+
+	// march 5, march 5th 2025, 5 march, 5th of march
+	var month time.Month
+	var day, n int
+	if m, ok := quickMonths[word]; ok {
+		if d, ok := quickDayOfMonth(p.at(i + 1)); ok {
+			month, day, n = m, d, 2
+		}
+	} else if d, ok := quickDayOfMonth(word); ok {
+		j := i + 1
+		if p.at(j) == "of" {
+			j++
+		}
+		if m, ok := quickMonths[p.at(j)]; ok {
+			month, day, n = m, d, j-i+1
+		}
+	}
+	if n == 0 {
+		return 0, time.Time{}
+	}
+
+	year, explicitYear := today.Year(), false
+	if y, err := strconv.Atoi(p.at(i + n)); err == nil && len(p.at(i+n)) == 4 {
+		year, explicitYear = y, true
+		n++
+	}
+	date := time.Date(year, month, day, 0, 0, 0, 0, p.now.Location())
+	if date.Day() != day {
+		return 0, time.Time{} // february 30th and the like
+	}
+	if !explicitYear && date.Before(today) {
+		date = date.AddDate(1, 0, 0)
+	}
+	return n, date
+}
+
+// matchTime reads 9am, 9:30 pm, 17:00, noon, or a bare hour after "at"
+func (p *quickParser) matchTime(i int) (int, int, int) {
+	j, afterAt := i, false
+	if p.at(i) == "at" || p.at(i) == "@" {
+		j, afterAt = i+1, true
+	}
+
+	switch p.at(j) {
+	case "noon":
+		return j - i + 1, 12, 0
+	case "midnight":
+		return j - i + 1, 0, 0
+	}
+
+	m := quickClock.FindStringSubmatch(p.at(j))
+	if m == nil {
+		return 0, 0, 0
+	}
+	n := j - i + 1
+	hour, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	suffix := m[3]
+	if suffix == "" && (p.at(j+1) == "am" || p.at(j+1) == "pm") {
+		suffix = p.at(j + 1)
+		n++
+	}
+
+	switch {
+	case suffix != "":
+		if hour < 1 || hour > 12 {
+			return 0, 0, 0
+		}
+		hour %= 12
+		if suffix == "pm" {
+			hour += 12
+		}
+	case m[2] == "" && !afterAt:
+		return 0, 0, 0 // a lone number is more likely part of the title
+	case hour > 23:
+		return 0, 0, 0
+	}
+	if minute > 59 {
+		return 0, 0, 0
+	}
+	return n, hour, minute
+}
+
+// matchRecurrence reads daily, weekly, monthly or an "every ..." phrase,
+// optionally followed by "until <date>" or "for N times"
+func (p *quickParser) matchRecurrence(i int) (int, *recurrenceRule) {
+	rule := &recurrenceRule{Interval: 1, WeekStart: time.Monday}
+	n := 0
+
+	switch p.at(i) {
+	case "daily":
+		rule.Freq, n = "DAILY", 1
+	case "weekly":
+		rule.Freq, n = "WEEKLY", 1
+	case "monthly":
+		rule.Freq, n = "MONTHLY", 1
+	case "every", "each":
+		n = 1
+		if p.at(i+n) == "other" {
+			rule.Interval = 2
+			n++
+		} else if interval, ok := quickNumber(p.at(i + n)); ok && interval > 1 {
+			rule.Interval = interval
+			n++
+		}
+
+		switch unit := p.at(i + n); unit {
+		case "day", "days":
+			rule.Freq = "DAILY"
+			n++
+		case "weekday", "weekdays", "workday", "workdays":
+			rule.Freq = "WEEKLY"
+			for _, day := range []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday} {
+				rule.ByDay = append(rule.ByDay, weekdayNum{Day: day})
+			}
+			n++
+		case "weekend", "weekends":
+			rule.Freq = "WEEKLY"
+			rule.ByDay = []weekdayNum{{Day: time.Saturday}, {Day: time.Sunday}}
+			n++
+		case "week", "weeks":
+			rule.Freq = "WEEKLY"
+			n++
+			if p.at(i+n) == "on" {
+				if m, days := p.matchWeekdays(i + n + 1); m > 0 {
+					rule.ByDay = days
+					n += 1 + m
+				}
+			}
+		case "month", "months":
+			rule.Freq = "MONTHLY"
+			n++
+			if p.at(i+n) == "on" {
+				j := i + n + 1
+				if p.at(j) == "the" {
+					j++
+				}
+				if m := p.matchMonthDay(j, rule); m > 0 {
+					n = j - i + m
+				}
+			}
+		default:
+			if m, days := p.matchWeekdays(i + n); m > 0 {
+				rule.Freq = "WEEKLY"
+				rule.ByDay = days
+				n += m
+			} else if m := p.matchMonthDay(i+n, rule); m > 0 {
+				rule.Freq = "MONTHLY"
+				n += m
+				if p.at(i+n) == "of" && p.at(i+n+1) == "the" && p.at(i+n+2) == "month" {
+					n += 3
+				} else if p.at(i+n) == "of" && (p.at(i+n+1) == "every" || p.at(i+n+1) == "each") && p.at(i+n+2) == "month" {
+					n += 3
+				}
+			}
+		}
+	}
+	if rule.Freq == "" {
+		return 0, nil
+	}
+	return n + p.matchRecurrenceEnd(i+n, rule), rule
+}
+
+// matchRecurrenceEnd reads "until <date>" or "for N times" into rule
+func (p *quickParser) matchRecurrenceEnd(i int, rule *recurrenceRule) int {
+	if p.at(i) == "until" {
+		if n, until := p.matchDate(i + 1); n > 0 {
+			rule.Until = until.Add(24*time.Hour - time.Second)
+			return 1 + n
+		}
+		return 0
+	}
+
+	j := i
+	if p.at(j) == "for" {
+		j++
+	}
+	if count, ok := quickNumber(p.at(j)); ok && (p.at(j+1) == "times" || p.at(j+1) == "occurrences") {
+		rule.Count = count
+		return j - i + 2
+	}
+	return 0
+}
+
+// matchWeekdays reads "monday", "mon and thu" or "monday, wednesday & friday"
+func (p *quickParser) matchWeekdays(i int) (int, []weekdayNum) {
+	var days []weekdayNum
+	n := 0
+	for {
+		word := p.at(i + n)
+		if (word == "and" || word == "&") && len(days) > 0 {
+			if _, ok := quickWeekdays[p.at(i+n+1)]; ok {
+				n++
+				continue
+			}
+			break
+		}
+		weekday, ok := quickWeekdays[word]
+		if !ok {
+			break
+		}
+		days = append(days, weekdayNum{Day: weekday})
+		n++
+	}
+	return n, days
+}
+
+// matchMonthDay reads "1st", "15", "last day" or "2nd tuesday" into a
+// monthly rule
+func (p *quickParser) matchMonthDay(i int, rule *recurrenceRule) int {
+	word := p.at(i)
+	if ordinal, ok := quickOrdinal(word); ok {
+		if weekday, ok := quickWeekdays[p.at(i+1)]; ok {
+			rule.ByDay = []weekdayNum{{Day: weekday, N: ordinal}}
+			return 2
+		}
+	}
+	if word == "last" && p.at(i+1) == "day" {
+		rule.ByMonthDay = []int{-1}
+		return 2
+	}
+	if day, ok := quickDayOfMonth(word); ok {
+		rule.ByMonthDay = []int{day}
+		return 1
+	}
+	return 0
+}
+
+// matchesDay tells whether a recurrence could fall on day
+func (r *recurrenceRule) matchesDay(day time.Time) bool {
+	if r.Freq != "MONTHLY" {
+		return len(r.ByDay) == 0 || r.hasWeekday(day.Weekday())
+	}
+
+	daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+	for _, monthDay := range r.ByMonthDay {
+		if monthDay < 0 {
+			monthDay = daysInMonth + monthDay + 1
+		}
+		if monthDay == day.Day() {
+			return true
+		}
+	}
+	for _, wd := range r.ByDay {
+		for _, monthDay := range nthWeekdays(day.Year(), day.Month(), daysInMonth, wd) {
+			if monthDay == day.Day() {
+				return true
+			}
+		}
+	}
+	return len(r.ByMonthDay) == 0 && len(r.ByDay) == 0
+}
+
+func (p *quickParser) title() string {
+	var words []string
+	for i, word := range p.words {
+		if !p.used[i] {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// due works out the due date. A recurrence without a date starts on its
+// first matching day from now, a time without a date is the next time the
+// clock shows it.
+func (p *quickParser) due() time.Time {
+	hour, minute := quickAddDefaultHour, quickAddDefaultMinute
+	if p.hasTime {
+		hour, minute = p.hour, p.minute
+	}
+	at := func(day time.Time) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location())
+	}
+	today := startOfDay(p.now)
+
+	switch {
+	case !p.date.IsZero():
+		return at(p.date)
+	case p.rule != nil:
+		for i := 0; i <= 400; i++ {
+			day := today.AddDate(0, 0, i)
+			if p.rule.matchesDay(day) && at(day).After(p.now) {
+				return at(day)
+			}
+		}
+		return time.Time{}
+	case p.hasTime:
+		if due := at(today); due.After(p.now) {
+			return due
+		}
+		return at(today.AddDate(0, 0, 1))
+	}
+	return time.Time{}
+}
+
+// quickAddTask creates a task from one line of text. Labels that don't
+// exist yet are created with the default color. With ?preview=true nothing
+// is stored and the parsed task is only returned.
+func quickAddTask(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	req := new(QuickAddRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "text is required"})
+	}
+	if req.TZ == "" {
+		req.TZ = "UTC"
+	}
+	loc, err := time.LoadLocation(req.TZ)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown time zone"})
+	}
+	now := time.Now()
+	if req.Now != "" {
+		if now, err = time.Parse(time.RFC3339, req.Now); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "now must be an RFC 3339 time"})
+		}
+	}
+
+	parsed, err := parseQuickAdd(req.Text, now.In(loc))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	createdAt := time.Now()
+	task := &Task{
+		ID:        uuid.New().String(),
+		Title:     parsed.title(),
+		Status:    StatusTodo,
+		DueDate:   parsed.due(),
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+		Version:   1,
+		Username:  username,
+		Labels:    parsed.labels,
+		Priority:  parsed.priority,
+	}
+	if parsed.rule != nil {
+		task.RRule = parsed.rule.String()
+	}
+	recordStatus(task, "", createdAt)
+	parts := parsed.parts
+	if parts == nil {
+		parts = []QuickAddPart{}
+	}
+
+	if c.QueryBool("preview") {
+		return c.JSON(fiber.Map{"task": task, "parts": parts})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// unknown labels are created with the task, so nothing is created for a
+	// task that gets rejected
+	createdLabels := []string{}
+	for _, name := range task.Labels {
+		name = normalizeLabel(name)
+		if _, exists := labels[username][name]; !exists && !contains(createdLabels, name) {
+			createdLabels = append(createdLabels, name)
+		}
+	}
+	if err := validateLabelsWith(task, createdLabels); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if task.RRule != "" {
+		if err := startSeries(task); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	if labels[username] == nil && len(createdLabels) > 0 {
+		labels[username] = make(map[string]Label)
+	}
+	for _, name := range createdLabels {
+		labels[username][name] = Label{Name: name, Color: defaultLabelColor}
+	}
+	insertStored(username, *task)
+
+	setETag(c, *task)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"task": task, "parts": parts, "created_labels": createdLabels})
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// TaskSeries is the template every occurrence of a recurring task is built
+// from. Editing "all future occurrences" changes the series, editing "this
+// occurrence" only changes the task.
+type TaskSeries struct {
+	ID             string    `json:"id"`
+	Username       string    `json:"username"`
+	Title          string    `json:"title"`
+	Description    string    `json:"description"`
+	RRule          string    `json:"rrule"`
+	Start          time.Time `json:"start"`           // due date of occurrence 1
+	LastOccurrence int       `json:"last_occurrence"` // highest occurrence created so far
+}
+
+// series by id, dropped once no task in the list or the trash refers to it
+var series = make(map[string]TaskSeries)
+
+const (
+	maxPreviewCount      = 100
+	maxRecurrencePeriods = 50000 // how far ahead occurrences are looked for, rules are checked with canMatch first
+
+	// the Gregorian calendar repeats every 400 years, so a rule that matches
+	// nothing in this many periods never matches
+	dailyCycle   = 7
+	monthlyCycle = 400 * 12
+)
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+type weekdayNum struct {
+	Day time.Weekday
+	N   int // only for MONTHLY, 2 = second, -1 = last, 0 = every
+}
+
+// recurrenceRule is the subset of RFC 5545 RRULE we support:
+// FREQ=DAILY|WEEKLY|MONTHLY with INTERVAL, BYDAY, BYMONTHDAY, WKST and COUNT or UNTIL
+type recurrenceRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []weekdayNum
+	ByMonthDay []int
+	WeekStart  time.Weekday
+	Count      int
+	Until      time.Time
+}
+
+func parseRRule(raw string) (*recurrenceRule, error) {
+	raw = strings.TrimPrefix(strings.TrimSpace(raw), "RRULE:")
+	if raw == "" {
+		return nil, errors.New("empty recurrence rule")
+	}
+
+	rule := &recurrenceRule{Interval: 1, WeekStart: time.Monday}
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(raw, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		value = strings.ToUpper(strings.TrimSpace(value))
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("malformed rule part %q", part)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%s given more than once", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY":
+				rule.Freq = value
+			default:
+				return nil, fmt.Errorf("unsupported FREQ %s, use DAILY, WEEKLY or MONTHLY", value)
+			}
+		case "INTERVAL":
+			interval, err := strconv.Atoi(value)
+			if err != nil || interval < 1 {
+				return nil, errors.New("INTERVAL must be a positive number")
+			}
+			rule.Interval = interval
+		case "COUNT":
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 1 {
+				return nil, errors.New("COUNT must be a positive number")
+			}
+			rule.Count = count
+		case "UNTIL":
+			until, err := parseRRuleTime(value)
+			if err != nil {
+				return nil, errors.New("UNTIL must look like 20261231 or 20261231T235959Z")
+			}
+			rule.Until = until
+		case "WKST":
+			day, ok := rruleWeekdays[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown WKST %s", value)
+			}
+			rule.WeekStart = day
+		case "BYDAY":
+			for _, item := range strings.Split(value, ",") {
+				day, err := parseWeekdayNum(item)
+				if err != nil {
+					return nil, err
+				}
+				rule.ByDay = append(rule.ByDay, day)
+			}
+		case "BYMONTHDAY":
+			for _, item := range strings.Split(value, ",") {
+				day, err := strconv.Atoi(item)
+				if err != nil || day == 0 || day < -31 || day > 31 {
+					return nil, fmt.Errorf("invalid BYMONTHDAY %s", item)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, day)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported rule part %s", key)
+		}
+	}
+
+	if rule.Freq == "" {
+		return nil, errors.New("FREQ is required")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return nil, errors.New("COUNT and UNTIL cannot be used together")
+	}
+	if rule.Freq != "MONTHLY" {
+		if len(rule.ByMonthDay) > 0 {
+			return nil, errors.New("BYMONTHDAY is only allowed with FREQ=MONTHLY")
+		}
+		for _, day := range rule.ByDay {
+			if day.N != 0 {
+				return nil, errors.New("numbered BYDAY like 2MO is only allowed with FREQ=MONTHLY")
+			}
+		}
+	}
+
+	return rule, nil
+}
+
+func parseRRuleTime(value string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("20060102T150405", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("20060102", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// a date-only UNTIL includes that whole day
+	return t.Add(24*time.Hour - time.Second), nil
+}
+
+func parseWeekdayNum(item string) (weekdayNum, error) {
+	if len(item) < 2 {
+		return weekdayNum{}, fmt.Errorf("invalid BYDAY %s", item)
+	}
+	day, ok := rruleWeekdays[item[len(item)-2:]]
+	if !ok {
+		return weekdayNum{}, fmt.Errorf("invalid BYDAY %s", item)
+	}
+	result := weekdayNum{Day: day}
+	if prefix := item[:len(item)-2]; prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return weekdayNum{}, fmt.Errorf("invalid BYDAY %s", item)
+		}
+		result.N = n
+	}
+	return result, nil
+}
+
+// String gives the canonical form we store on tasks
+func (r *recurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, day := range r.ByDay {
+			name := strings.ToUpper(day.Day.String()[:2])
+			if day.N != 0 {
+				name = strconv.Itoa(day.N) + name
+			}
+			days = append(days, name)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		var days []string
+		for _, day := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(day))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+strings.ToUpper(r.WeekStart.String()[:2]))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// iterate calls fn with every occurrence in order, numbered from 1, until fn
+// returns false or the rule runs out. The start itself is always occurrence 1,
+// like DTSTART in RFC 5545.
+func (r *recurrenceRule) iterate(start time.Time, fn func(n int, at time.Time) bool) {
+	n := 1
+	if !r.Until.IsZero() && start.After(r.Until) {
+		return
+	}
+	if !fn(n, start) {
+		return
+	}
+
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		for _, at := range r.candidates(start, period) {
+			if !at.After(start) {
+				continue
+			}
+			if r.Count > 0 && n >= r.Count {
+				return
+			}
+			if !r.Until.IsZero() && at.After(r.Until) {
+				return
+			}
+			n++
+			if !fn(n, at) {
+				return
+			}
+		}
+	}
+}
+
+// canMatch tells whether the rule produces any date after start. WEEKLY
+// always does, DAILY and MONTHLY rules can ask for days that never come, like
+// BYMONTHDAY=31 every 12 months from April.
+func (r *recurrenceRule) canMatch(start time.Time) bool {
+	cycle := 1
+	switch r.Freq {
+	case "DAILY":
+		cycle = dailyCycle
+	case "MONTHLY":
+		cycle = monthlyCycle
+	}
+	for period := 1; period <= cycle; period++ {
+		if len(r.candidates(start, period)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRRuleFrom parses raw and makes sure it has occurrences after start
+func parseRRuleFrom(raw string, start time.Time) (*recurrenceRule, error) {
+	rule, err := parseRRule(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !rule.canMatch(start) {
+		return nil, errors.New("the recurrence rule never matches a date after the due date")
+	}
+	return rule, nil
+}
+
+// candidates lists the dates of one DAILY/WEEKLY/MONTHLY period in order,
+// all at the time of day of start
+func (r *recurrenceRule) candidates(start time.Time, period int) []time.Time {
+	hour, minute, sec := start.Clock()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hour, minute, sec, start.Nanosecond(), start.Location())
+	}
+	y, m, d := start.Date()
+
+	switch r.Freq {
+	case "DAILY":
+		day := at(y, m, d+period*r.Interval)
+		if len(r.ByDay) > 0 && !r.hasWeekday(day.Weekday()) {
+			return nil
+		}
+		return []time.Time{day}
+
+	case "WEEKLY":
+		offset := (int(start.Weekday()) - int(r.WeekStart) + 7) % 7
+		weekStart := d - offset + period*r.Interval*7
+		days := r.ByDay
+		if len(days) == 0 {
+			days = []weekdayNum{{Day: start.Weekday()}}
+		}
+		var result []time.Time
+		for _, day := range days {
+			result = append(result, at(y, m, weekStart+(int(day.Day)-int(r.WeekStart)+7)%7))
+		}
+		return sortedUnique(result)
+
+	default: // MONTHLY
+		first := time.Date(y, m+time.Month(period*r.Interval), 1, 0, 0, 0, 0, start.Location())
+		year, month := first.Year(), first.Month()
+		daysInMonth := time.Date(year, month+1, 0, 0, 0, 0, 0, start.Location()).Day()
+
+		var monthDays []int
+		for _, day := range r.ByMonthDay {
+			if day < 0 {
+				day = daysInMonth + day + 1
+			}
+			if day >= 1 && day <= daysInMonth {
+				monthDays = append(monthDays, day)
+			}
+		}
+
+		var weekDays []int
+		for _, wd := range r.ByDay {
+			weekDays = append(weekDays, nthWeekdays(year, month, daysInMonth, wd)...)
+		}
+
+		var days []int
+		switch {
+		case len(r.ByMonthDay) > 0 && len(r.ByDay) > 0:
+			// both given, BYDAY narrows BYMONTHDAY down
+			for _, day := range monthDays {
+				for _, wd := range weekDays {
+					if day == wd {
+						days = append(days, day)
+					}
+				}
+			}
+		case len(r.ByMonthDay) > 0:
+			days = monthDays
+		case len(r.ByDay) > 0:
+			days = weekDays
+		default:
+			// months that don't have this day are skipped, as in RFC 5545
+			if d <= daysInMonth {
+				days = []int{d}
+			}
+		}
+
+		var result []time.Time
+		for _, day := range days {
+			result = append(result, at(year, month, day))
+		}
+		return sortedUnique(result)
+	}
+}
+
+func (r *recurrenceRule) hasWeekday(day time.Weekday) bool {
+	for _, wd := range r.ByDay {
+		if wd.Day == day {
+			return true
+		}
+	}
+	return false
+}
+
+// nthWeekdays returns the days of month matching something like 2TU, -1FR or TU
+func nthWeekdays(year int, month time.Month, daysInMonth int, wd weekdayNum) []int {
+	var matches []int
+	for day := 1; day <= daysInMonth; day++ {
+		if time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday() == wd.Day {
+			matches = append(matches, day)
+		}
+	}
+	switch {
+	case wd.N == 0:
+		return matches
+	case wd.N > 0 && wd.N <= len(matches):
+		return []int{matches[wd.N-1]}
+	case wd.N < 0 && -wd.N <= len(matches):
+		return []int{matches[len(matches)+wd.N]}
+	}
+	return nil
+}
+
+func sortedUnique(times []time.Time) []time.Time {
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	result := times[:0]
+	for i, t := range times {
+		if i == 0 || !t.Equal(times[i-1]) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// occurrence returns the due date of occurrence n, false when the rule ends before it
+func (r *recurrenceRule) occurrence(start time.Time, n int) (time.Time, bool) {
+	var found time.Time
+	ok := false
+	r.iterate(start, func(i int, at time.Time) bool {
+		if i == n {
+			found, ok = at, true
+			return false
+		}
+		return true
+	})
+	return found, ok
+}
+
+// upcoming lists up to count occurrences that come after occurrence number after
+func (r *recurrenceRule) upcoming(start time.Time, after, count int) []time.Time {
+	result := []time.Time{}
+	r.iterate(start, func(i int, at time.Time) bool {
+		if i > after {
+			result = append(result, at)
+		}
+		return len(result) < count
+	})
+	return result
+}
+
+// startSeries turns task into occurrence 1 of a new series, caller must hold the mutex
+func startSeries(task *Task) error {
+	if task.DueDate.IsZero() {
+		return errors.New("recurring tasks need a due_date")
+	}
+	rule, err := parseRRuleFrom(task.RRule, task.DueDate)
+	if err != nil {
+		return err
+	}
+
+	s := TaskSeries{
+		ID:             uuid.New().String(),
+		Username:       task.Username,
+		Title:          task.Title,
+		Description:    task.Description,
+		RRule:          rule.String(),
+		Start:          task.DueDate,
+		LastOccurrence: 1,
+	}
+	series[s.ID] = s
+
+	task.RRule = s.RRule
+	task.SeriesID = s.ID
+	task.Occurrence = 1
+	return nil
+}
+
+// applySeriesEdit applies the recurrence side of an update. With scope "this"
+// only the task changes. With scope "future" the series template changes, and
+// a new rule or due date splits off a new series starting at this occurrence,
+// see dropLaterOccurrences. Caller must hold the mutex.
+func applySeriesEdit(actor string, stored Task, task *Task, scope string) error {
+	if stored.SeriesID == "" {
+		if task.RRule == "" {
+			return nil
+		}
+		return startSeries(task)
+	}
+
+	if scope == "this" {
+		if task.RRule != stored.RRule {
+			return errors.New("changing the recurrence rule needs scope=future")
+		}
+		return nil
+	}
+
+	if task.RRule != stored.RRule || !task.DueDate.Equal(stored.DueDate) {
+		if task.RRule == "" {
+			task.SeriesID = ""
+			task.Occurrence = 0
+		} else if err := startSeries(task); err != nil {
+			return err
+		}
+		dropLaterOccurrences(actor, stored)
+		return nil
+	}
+
+	s := series[stored.SeriesID]
+	s.Title = task.Title
+	s.Description = task.Description
+	series[s.ID] = s
+
+	for id, other := range tasks {
+		if id != task.ID && other.SeriesID == s.ID && other.Occurrence > stored.Occurrence && isOpen(other) {
+			other.Title = s.Title
+			other.Description = s.Description
+			updateStored(actor, &other)
+		}
+	}
+	return nil
+}
+
+// dropLaterOccurrences moves the open occurrences after split to the trash
+// once split leaves its series, they would show up next to the new series.
+// Done ones stay as the record of the old rule. Caller must hold the mutex.
+func dropLaterOccurrences(actor string, split Task) {
+	var later []Task
+	for id, other := range tasks {
+		if id != split.ID && other.SeriesID == split.SeriesID && other.Occurrence > split.Occurrence && isOpen(other) {
+			later = append(later, other)
+		}
+	}
+	for _, other := range later {
+		if _, exists := tasks[other.ID]; exists { // may be gone with an earlier tree
+			removeTaskTree(actor, tasks[other.ID])
+		}
+	}
+}
+
+// forgetSeries drops a series once its last task is gone for good. Tasks in
+// the trash still hold on to it so they can be restored. Caller must hold the
+// mutex.
+func forgetSeries(seriesID string) {
+	if seriesID == "" {
+		return
+	}
+	for _, task := range tasks {
+		if task.SeriesID == seriesID {
+			return
+		}
+	}
+	for _, trashed := range trash {
+		if trashed.Task.SeriesID == seriesID {
+			return
+		}
+	}
+	delete(series, seriesID)
+}
+
+// spawnNextOccurrence creates the task after done, if the series has one left.
+// Completing the same occurrence twice (done, reopened, done) only creates it once.
+// Caller must hold the mutex.
+func spawnNextOccurrence(actor string, done Task) (Task, bool) {
+	s, ok := series[done.SeriesID]
+	if !ok || done.Occurrence < s.LastOccurrence {
+		return Task{}, false
+	}
+	rule, err := parseRRule(s.RRule)
+	if err != nil {
+		return Task{}, false
+	}
+	due, ok := rule.occurrence(s.Start, done.Occurrence+1)
+	if !ok {
+		return Task{}, false
+	}
+
+	now := time.Now()
+	next := Task{
+		ID:          uuid.New().String(),
+		Title:       s.Title,
+		Description: s.Description,
+		Status:      StatusTodo,
+		DueDate:     due,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Version:     1,
+		Username:    s.Username,
+		RRule:       s.RRule,
+		SeriesID:    s.ID,
+		Occurrence:  done.Occurrence + 1,
+		ParentID:    done.ParentID,
+		List:        done.List,
+		Labels:      done.Labels,
+		Priority:    done.Priority,
+	}
+	recordStatus(&next, "", now)
+	insertStored(actor, next)
+	if shares := taskShares[done.ID]; len(shares) > 0 {
+		taskShares[next.ID] = make(map[string]string)
+		for collaborator, role := range shares {
+			taskShares[next.ID][collaborator] = role
+		}
+	}
+
+	s.LastOccurrence = next.Occurrence
+	series[s.ID] = s
+	return next, true
+}
+
+func parsePreviewCount(c *fiber.Ctx) (int, error) {
+	count, err := strconv.Atoi(c.Query("count", "10"))
+	if err != nil || count < 1 {
+		return 0, errors.New("count must be a positive number")
+	}
+	if count > maxPreviewCount {
+		count = maxPreviewCount
+	}
+	return count, nil
+}
+
+// previewRecurrence lists the dates a rule would produce before it is saved:
+// GET /api/recurrence/preview?rrule=FREQ=WEEKLY;BYDAY=MO&start=2026-01-05T09:00:00Z
+func previewRecurrence(c *fiber.Ctx) error {
+	start, err := time.Parse(time.RFC3339, c.Query("start"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "start must be an RFC 3339 time"})
+	}
+	rule, err := parseRRuleFrom(c.Query("rrule"), start)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	count, err := parsePreviewCount(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"rrule": rule.String(), "dates": rule.upcoming(start, 0, count)})
+}
+
+// upcomingOccurrences lists the due dates that follow a recurring task
+func upcomingOccurrences(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+
+	count, err := parsePreviewCount(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, taskID, RoleViewer)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	s, ok := series[task.SeriesID]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "task is not recurring"})
+	}
+	rule, err := parseRRule(s.RRule)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "stored recurrence rule is invalid"})
+	}
+
+	return c.JSON(fiber.Map{"rrule": s.RRule, "dates": rule.upcoming(s.Start, task.Occurrence, count)})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// resetStore empties every in-memory index so tests don't see each other
+func resetStore() {
+	tasks = make(map[string]Task)
+	userTasks = make(map[string][]string)
+	trash = make(map[string]TrashedTask)
+	events = make(map[string]TaskEvent)
+	taskEvents = make(map[string][]string)
+	series = make(map[string]TaskSeries)
+	taskShares = make(map[string]map[string]string)
+}
+
+// complete marks an occurrence done and returns the one spawned after it
+func complete(t *testing.T, task Task) Task {
+	t.Helper()
+	task.Status = StatusDone
+	updateStored("ann", &task)
+	next, ok := spawnNextOccurrence("ann", task)
+	if !ok {
+		t.Fatalf("no occurrence after %d", task.Occurrence)
+	}
+	return next
+}
+
+func TestFutureSplitDropsLaterOccurrences(t *testing.T) {
+	resetStore()
+	first := &Task{
+		ID:       uuid.New().String(),
+		Title:    "standup",
+		Status:   StatusTodo,
+		DueDate:  time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+		Username: "ann",
+		RRule:    "FREQ=DAILY",
+	}
+	if err := startSeries(first); err != nil {
+		t.Fatal(err)
+	}
+	insertStored("ann", *first)
+	second := complete(t, tasks[first.ID])
+	third := complete(t, second)
+
+	// reopen the first one and move it and everything after to weekly
+	stored := tasks[first.ID]
+	edited := stored
+	edited.Status = StatusInProgress
+	edited.RRule = "FREQ=WEEKLY"
+	if err := applySeriesEdit("ann", stored, &edited, "future"); err != nil {
+		t.Fatal(err)
+	}
+	updateStored("ann", &edited)
+
+	if edited.SeriesID == stored.SeriesID {
+		t.Fatal("edit did not split off a new series")
+	}
+	if _, exists := tasks[third.ID]; exists {
+		t.Error("open occurrence of the old series is still there after the split")
+	}
+	if _, inTrash := trash[third.ID]; !inTrash {
+		t.Error("dropped occurrence is not in the trash")
+	}
+	if task, exists := tasks[second.ID]; !exists || task.SeriesID != stored.SeriesID {
+		t.Error("done occurrence of the old series was not kept")
+	}
+}
+
+func TestThisScopeKeepsLaterOccurrences(t *testing.T) {
+	resetStore()
+	first := &Task{
+		ID:       uuid.New().String(),
+		Title:    "standup",
+		Status:   StatusTodo,
+		DueDate:  time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+		Username: "ann",
+		RRule:    "FREQ=DAILY",
+	}
+	if err := startSeries(first); err != nil {
+		t.Fatal(err)
+	}
+	insertStored("ann", *first)
+	second := complete(t, tasks[first.ID])
+
+	stored := tasks[first.ID]
+	edited := stored
+	edited.DueDate = stored.DueDate.Add(time.Hour)
+	if err := applySeriesEdit("ann", stored, &edited, "this"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := tasks[second.ID]; !exists {
+		t.Error("editing one occurrence dropped the next one")
+	}
+}
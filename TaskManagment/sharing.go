@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// listKey names one user's list, lists are just the List field on their tasks
+type listKey struct {
+	Owner string
+	List  string
+}
+
+var (
+	taskShares = make(map[string]map[string]string)  // task id -> collaborator -> role
+	listShares = make(map[listKey]map[string]string) // list -> collaborator -> role
+)
+
+var (
+	errTaskNotFound = errors.New("task not found or unauthorized access")
+	errViewOnly     = errors.New("you only have view access to this task")
+	errOwnerOnly    = errors.New("only the owner of the task can do this")
+)
+
+type ShareRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"` // viewer or editor
+}
+
+type Share struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// roleFor returns the caller's role on a task, or "" when they can't see it.
+// Sharing a task also shares its subtasks.
+func roleFor(username string, task Task) string {
+	if task.Username == username {
+		return RoleOwner
+	}
+
+	role := listShares[listKey{Owner: task.Username, List: task.List}][username]
+	for id := task.ID; id != ""; id = tasks[id].ParentID {
+		if shared := taskShares[id][username]; roleRank[shared] > roleRank[role] {
+			role = shared
+		}
+	}
+	return role
+}
+
+// accessTask loads a task for the caller and checks they hold at least the
+// needed role on it, caller must hold the mutex
+func accessTask(username, taskID, need string) (Task, error) {
+	task, exists := tasks[taskID]
+	if !exists {
+		return Task{}, errTaskNotFound
+	}
+	role := roleFor(username, task)
+	switch {
+	case role == "":
+		return Task{}, errTaskNotFound
+	case roleRank[role] >= roleRank[need]:
+		return task, nil
+	case need == RoleOwner:
+		return Task{}, errOwnerOnly
+	default:
+		return Task{}, errViewOnly
+	}
+}
+
+func hasShares(username string) bool {
+	for _, shares := range taskShares {
+		if shares[username] != "" {
+			return true
+		}
+	}
+	for _, shares := range listShares {
+		if shares[username] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleTasks is every task the user owns or has been given access to,
+// caller must hold the mutex
+func visibleTasks(username string) []Task {
+	var result []Task
+	for _, taskID := range userTasks[username] {
+		result = append(result, tasks[taskID])
+	}
+
+	if !hasShares(username) {
+		return result
+	}
+	for _, task := range tasks {
+		if task.Username != username && roleFor(username, task) != "" {
+			result = append(result, task)
+		}
+	}
+	return result
+}
+
+func sortedShares(shares map[string]string) []Share {
+	result := []Share{}
+	for username, role := range shares {
+		result = append(result, Share{Username: username, Role: role})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
+	return result
+}
+
+func validateShare(req *ShareRequest, owner string) error {
+	if req.Role != RoleViewer && req.Role != RoleEditor {
+		return errors.New("role must be viewer or editor")
+	}
+	if req.Username == owner {
+		return errors.New("cannot share with yourself")
+	}
+	if _, exists := users[req.Username]; !exists {
+		return errors.New("user not found")
+	}
+	return nil
+}
+
+func getTask(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, c.Params("id"), RoleViewer)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	setETag(c, task)
+	if c.Get(fiber.HeaderIfNoneMatch) == etag(task) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	return c.JSON(fiber.Map{"task": task, "role": roleFor(username, task)})
+}
+
+func shareTask(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	req := new(ShareRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, c.Params("id"), RoleOwner)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := validateShare(req, username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if taskShares[task.ID] == nil {
+		taskShares[task.ID] = make(map[string]string)
+	}
+	taskShares[task.ID][req.Username] = req.Role
+
+	return c.JSON(sortedShares(taskShares[task.ID]))
+}
+
+func getTaskShares(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, c.Params("id"), RoleOwner)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(sortedShares(taskShares[task.ID]))
+}
+
+func unshareTask(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	collaborator := c.Params("username")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, c.Params("id"), RoleOwner)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	if _, shared := taskShares[task.ID][collaborator]; !shared {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "task is not shared with " + collaborator})
+	}
+
+	delete(taskShares[task.ID], collaborator)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// shareList gives access to every task, current and future, in one of the caller's lists
+func shareList(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	key := listKey{Owner: username, List: c.Params("list")}
+	req := new(ShareRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := validateShare(req, username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if listShares[key] == nil {
+		listShares[key] = make(map[string]string)
+	}
+	listShares[key][req.Username] = req.Role
+
+	return c.JSON(sortedShares(listShares[key]))
+}
+
+func getListShares(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	key := listKey{Owner: username, List: c.Params("list")}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return c.JSON(sortedShares(listShares[key]))
+}
+
+func unshareList(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	key := listKey{Owner: username, List: c.Params("list")}
+	collaborator := c.Params("username")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, shared := listShares[key][collaborator]; !shared {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "list is not shared with " + collaborator})
+	}
+
+	delete(listShares[key], collaborator)
+	return c.SendStatus(fiber.StatusNoContent)
+}
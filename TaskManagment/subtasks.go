@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TaskProgress is the completion rollup of a task and its subtasks
+type TaskProgress struct {
+	Task       Task           `json:"task"`
+	Completion float64        `json:"completion"` // percent, 0 to 100
+	Subtasks   []TaskProgress `json:"subtasks,omitempty"`
+}
+
+type BlockerRequest struct {
+	TaskID string `json:"task_id"`
+}
+
+var errOpenBlockers = errors.New("task is blocked by open tasks")
+
+// isOpen tells whether a task still blocks the tasks that depend on it
+func isOpen(task Task) bool {
+	return task.Status != StatusDone && task.Status != StatusCancelled
+}
+
+// childrenOf returns the direct subtasks of a task, caller must hold the mutex
+func childrenOf(taskID string) []Task {
+	var children []Task
+	for _, task := range tasks {
+		if task.ParentID == taskID {
+			children = append(children, task)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].CreatedAt.Before(children[j].CreatedAt) })
+	return children
+}
+
+// openBlockers lists the blockers of a task that are not finished yet
+func openBlockers(task Task) []string {
+	var open []string
+	for _, id := range task.BlockedBy {
+		if blocker, ok := tasks[id]; ok && isOpen(blocker) {
+			open = append(open, id)
+		}
+	}
+	return open
+}
+
+// validateRelations checks the parent and blockers a task is about to be saved
+// with. It cleans up duplicate blockers and rejects anything that would make
+// the subtask tree or the dependency graph cyclic. Caller must hold the mutex.
+func validateRelations(task *Task, username string) error {
+	if task.ParentID != "" {
+		if task.ParentID == task.ID {
+			return errors.New("a task cannot be its own parent")
+		}
+		parent, ok := tasks[task.ParentID]
+		if !ok || parent.Username != username {
+			return errors.New("parent task not found")
+		}
+		for id := parent.ParentID; id != ""; id = tasks[id].ParentID {
+			if id == task.ID {
+				return errors.New("parent task is a subtask of this task")
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var blockers []string
+	for _, id := range task.BlockedBy {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if id == task.ID {
+			return errors.New("a task cannot block itself")
+		}
+		blocker, ok := tasks[id]
+		if !ok || blocker.Username != username {
+			return errors.New("blocking task " + id + " not found")
+		}
+		blockers = append(blockers, id)
+	}
+	task.BlockedBy = blockers
+
+	if task.ID != "" && dependsOn(blockers, task.ID) {
+		return errors.New("dependency cycle: task would end up blocking itself")
+	}
+	return nil
+}
+
+// dependsOn walks the blocked-by graph from the given tasks and reports
+// whether target can be reached
+func dependsOn(from []string, target string) bool {
+	visited := make(map[string]bool)
+	stack := append([]string(nil), from...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == target {
+			return true
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		stack = append(stack, tasks[id].BlockedBy...)
+	}
+	return false
+}
+
+func progressOf(task Task) TaskProgress {
+	progress := TaskProgress{Task: task}
+
+	// cancelled subtasks are left out of the rollup
+	var children []Task
+	for _, child := range childrenOf(task.ID) {
+		if child.Status != StatusCancelled {
+			children = append(children, child)
+		}
+	}
+	if len(children) == 0 {
+		if task.Status == StatusDone {
+			progress.Completion = 100
+		}
+		return progress
+	}
+
+	total := 0.0
+	for _, child := range children {
+		childProgress := progressOf(child)
+		total += childProgress.Completion
+		progress.Subtasks = append(progress.Subtasks, childProgress)
+	}
+	progress.Completion = total / float64(len(children))
+	return progress
+}
+
+// removeTask moves a task to the trash and drops it from both indexes, its
+// shares and every blocked_by list. The trash keeps which tasks it blocked so
+// a restore can link them again. Caller must hold the mutex.
+func removeTask(actor string, task Task) TaskEvent {
+	now := time.Now()
+	trashed := TrashedTask{
+		Task:      task,
+		DeletedAt: now,
+		DeletedBy: actor,
+		PurgeAt:   now.Add(trashRetention),
+		Shares:    taskShares[task.ID],
+	}
+	delete(tasks, task.ID)
+	delete(taskShares, task.ID)
+	for i, id := range userTasks[task.Username] {
+		if id == task.ID {
+			userTasks[task.Username] = append(userTasks[task.Username][:i], userTasks[task.Username][i+1:]...)
+			break
+		}
+	}
+
+	for _, other := range tasks {
+		for i, blocker := range other.BlockedBy {
+			if blocker == task.ID {
+				other.BlockedBy = append(other.BlockedBy[:i:i], other.BlockedBy[i+1:]...)
+				updateStored(actor, &other)
+				trashed.Blocks = append(trashed.Blocks, other.ID)
+				break
+			}
+		}
+	}
+	trash[task.ID] = trashed
+	return recordEvent(actor, EventDeleted, &task, nil)
+}
+
+// removeTaskTree deletes a task together with all of its subtasks. The
+// trashed task remembers them, restoring it brings them back too.
+func removeTaskTree(actor string, task Task) {
+	var children []string
+	for _, child := range childrenOf(task.ID) {
+		removeTaskTree(actor, child)
+		children = append(children, child.ID)
+	}
+	removeTask(actor, task)
+	trashed := trash[task.ID]
+	trashed.Children = children
+	trash[task.ID] = trashed
+}
+
+func getTaskProgress(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, taskID, RoleViewer)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(progressOf(task))
+}
+
+func addBlocker(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+	req := new(BlockerRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, taskID, RoleEditor)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	task.BlockedBy = append(append([]string(nil), task.BlockedBy...), req.TaskID)
+	if err := validateRelations(&task, task.Username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	updateStored(username, &task)
+
+	return c.JSON(task)
+}
+
+func removeBlocker(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+	blockerID := c.Params("blockerId")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, taskID, RoleEditor)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var blockers []string
+	for _, id := range task.BlockedBy {
+		if id != blockerID {
+			blockers = append(blockers, id)
+		}
+	}
+	if len(blockers) == len(task.BlockedBy) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "task is not blocked by " + blockerID})
+	}
+	task.BlockedBy = blockers
+	updateStored(username, &task)
+
+	return c.JSON(task)
+}
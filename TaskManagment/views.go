@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// SmartView is a saved filter query that is evaluated again every time it is
+// opened, for example "priority >= high and due this week and label:work"
+type SmartView struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var views = make(map[string]SmartView)
+
+// taskFilter is a compiled view query, now is passed in so date words like
+// "today" are worked out when the view runs, not when it was saved
+type taskFilter func(task Task, now time.Time) bool
+
+// filter query grammar:
+//
+//	expr  = and { "or" and }
+//	and   = unary { ["and"] unary }
+//	unary = "not" unary | "(" expr ")" | term
+//	term  = label:NAME | #NAME | list:NAME | status:STATUS | text:WORD | "quoted text"
+//	      | priority [= >= > <= <] LEVEL | priority:LEVEL
+//	      | due today | tomorrow | overdue | none | this week | next week
+//	      | this month | next month | before DATE | after DATE | within N days
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+	offset int
+}
+
+func tokenizeFilter(query string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, filterToken{text: string(r), offset: i})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unclosed quote at position %d", i)
+			}
+			tokens = append(tokens, filterToken{text: string(runes[i+1 : end]), quoted: true, offset: i})
+			i = end + 1
+		case r == '>' || r == '<' || r == '=':
+			op := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' && r != '=' {
+				op += "="
+			}
+			tokens = append(tokens, filterToken{text: op, offset: i})
+			i += len(op)
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()\"<>=", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: strings.ToLower(string(runes[i:end])), offset: i})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func compileFilter(query string) (taskFilter, error) {
+	tokens, err := tokenizeFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("query is empty")
+	}
+	p := &filterParser{tokens: tokens}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, p.unexpected(tok)
+	}
+	return filter, nil
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return filterToken{}, errors.New("query ends too early")
+	}
+	p.pos++
+	return tok, nil
+}
+
+// keyword reports whether the next token is the given bare word and consumes it
+func (p *filterParser) keyword(word string) bool {
+	if tok, ok := p.peek(); ok && !tok.quoted && tok.text == word {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) unexpected(tok filterToken) error {
+	return fmt.Errorf("unexpected %q at position %d", tok.text, tok.offset)
+}
+
+func (p *filterParser) parseOr() (taskFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(task Task, now time.Time) bool { return l(task, now) || right(task, now) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (taskFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || (!tok.quoted && (tok.text == "or" || tok.text == ")")) {
+			return left, nil
+		}
+		p.keyword("and")
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(task Task, now time.Time) bool { return l(task, now) && right(task, now) }
+	}
+}
+
+func (p *filterParser) parseUnary() (taskFilter, error) {
+	if p.keyword("not") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(task Task, now time.Time) bool { return !inner(task, now) }, nil
+	}
+	if p.keyword("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		return inner, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *filterParser) parseTerm() (taskFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.quoted {
+		return textFilter(strings.ToLower(tok.text)), nil
+	}
+	if strings.HasPrefix(tok.text, "#") && len(tok.text) > 1 {
+		return labelFilter(tok.text[1:]), nil
+	}
+
+	if key, value, ok := strings.Cut(tok.text, ":"); ok {
+		if value == "" {
+			return nil, fmt.Errorf("missing value after %s: at position %d", key, tok.offset)
+		}
+		switch key {
+		case "label":
+			return labelFilter(value), nil
+		case "list":
+			return func(task Task, now time.Time) bool { return strings.ToLower(task.List) == value }, nil
+		case "status":
+			if _, known := allowedTransitions[value]; !known {
+				return nil, fmt.Errorf("unknown status %q at position %d", value, tok.offset)
+			}
+			return func(task Task, now time.Time) bool { return task.Status == value }, nil
+		case "text":
+			return textFilter(value), nil
+		case "priority":
+			return priorityFilter("=", value, tok.offset)
+		case "due":
+			return p.parseDue(filterToken{text: value, offset: tok.offset + len("due:")})
+		}
+		return nil, fmt.Errorf("unknown filter %q at position %d", key, tok.offset)
+	}
+
+	switch tok.text {
+	case "priority":
+		op := "="
+		if next, ok := p.peek(); ok && strings.ContainsAny(next.text, "<>=") && !next.quoted {
+			op = next.text
+			p.pos++
+		}
+		level, err := p.next()
+		if err != nil {
+			return nil, errors.New("priority needs a level")
+		}
+		return priorityFilter(op, level.text, level.offset)
+	case "due":
+		rangeTok, err := p.next()
+		if err != nil {
+			return nil, errors.New("due needs a range like today or this week")
+		}
+		return p.parseDue(rangeTok)
+	}
+	return nil, fmt.Errorf("unknown term %q at position %d, quote it to search text", tok.text, tok.offset)
+}
+
+func textFilter(word string) taskFilter {
+	return func(task Task, now time.Time) bool {
+		return strings.Contains(strings.ToLower(task.Title+" "+task.Description), word)
+	}
+}
+
+func labelFilter(name string) taskFilter {
+	return func(task Task, now time.Time) bool { return hasLabel(task, name) }
+}
+
+func priorityFilter(op, level string, offset int) (taskFilter, error) {
+	if level == "none" {
+		level = PriorityNone
+	}
+	want, ok := priorityRank[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown priority %q at position %d", level, offset)
+	}
+	compare := map[string]func(int) bool{
+		"=":  func(rank int) bool { return rank == want },
+		">":  func(rank int) bool { return rank > want },
+		">=": func(rank int) bool { return rank >= want },
+		"<":  func(rank int) bool { return rank < want },
+		"<=": func(rank int) bool { return rank <= want },
+	}[op]
+	return func(task Task, now time.Time) bool { return compare(priorityRank[task.Priority]) }, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// dueBetween matches tasks due in [from(now), to(now))
+func dueBetween(from, to func(now time.Time) time.Time) taskFilter {
+	return func(task Task, now time.Time) bool {
+		if task.DueDate.IsZero() {
+			return false
+		}
+		due := task.DueDate.In(now.Location())
+		return !due.Before(from(now)) && due.Before(to(now))
+	}
+}
+
+func weekStart(now time.Time) time.Time {
+	day := startOfDay(now)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)) // weeks start on Monday
+}
+
+func monthStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+}
+
+// parseDue reads the date range after "due", tok is its first word
+func (p *filterParser) parseDue(tok filterToken) (taskFilter, error) {
+	switch tok.text {
+	case "today":
+		return dueBetween(startOfDay, func(now time.Time) time.Time { return startOfDay(now).AddDate(0, 0, 1) }), nil
+	case "tomorrow":
+		return dueBetween(
+			func(now time.Time) time.Time { return startOfDay(now).AddDate(0, 0, 1) },
+			func(now time.Time) time.Time { return startOfDay(now).AddDate(0, 0, 2) },
+		), nil
+	case "overdue":
+		return func(task Task, now time.Time) bool {
+			return !task.DueDate.IsZero() && task.DueDate.Before(now) && isOpen(task)
+		}, nil
+	case "none":
+		return func(task Task, now time.Time) bool { return task.DueDate.IsZero() }, nil
+	case "this", "next":
+		unit, err := p.next()
+		if err != nil {
+			return nil, fmt.Errorf("%s needs week or month", tok.text)
+		}
+		shift := 0
+		if tok.text == "next" {
+			shift = 1
+		}
+		switch unit.text {
+		case "week":
+			return dueBetween(
+				func(now time.Time) time.Time { return weekStart(now).AddDate(0, 0, 7*shift) },
+				func(now time.Time) time.Time { return weekStart(now).AddDate(0, 0, 7*(shift+1)) },
+			), nil
+		case "month":
+			return dueBetween(
+				func(now time.Time) time.Time { return monthStart(now).AddDate(0, shift, 0) },
+				func(now time.Time) time.Time { return monthStart(now).AddDate(0, shift+1, 0) },
+			), nil
+		}
+		return nil, fmt.Errorf("expected week or month at position %d", unit.offset)
+	case "before", "after":
+		dateTok, err := p.next()
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a date like 2026-01-31", tok.text)
+		}
+		date, err := time.Parse("2006-01-02", dateTok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q at position %d, use YYYY-MM-DD", dateTok.text, dateTok.offset)
+		}
+		before := tok.text == "before"
+		return func(task Task, now time.Time) bool {
+			if task.DueDate.IsZero() {
+				return false
+			}
+			day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, now.Location())
+			if before {
+				return task.DueDate.Before(day)
+			}
+			return !task.DueDate.Before(day.AddDate(0, 0, 1))
+		}, nil
+	case "within":
+		countTok, err := p.next()
+		if err != nil {
+			return nil, errors.New("within needs a number of days")
+		}
+		days, err := strconv.Atoi(countTok.text)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid number %q at position %d", countTok.text, countTok.offset)
+		}
+		p.keyword("days")
+		p.keyword("day")
+		return dueBetween(
+			func(now time.Time) time.Time { return now },
+			func(now time.Time) time.Time { return now.AddDate(0, 0, days) },
+		), nil
+	}
+	return nil, fmt.Errorf("unknown due range %q at position %d", tok.text, tok.offset)
+}
+
+func createView(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	view := new(SmartView)
+	if err := c.BodyParser(view); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if strings.TrimSpace(view.Name) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name is required"})
+	}
+	if _, err := compileFilter(view.Query); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid query: " + err.Error()})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	view.ID = uuid.New().String()
+	view.Username = username
+	view.CreatedAt = time.Now()
+	views[view.ID] = *view
+
+	return c.Status(fiber.StatusCreated).JSON(view)
+}
+
+func getViews(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	result := []SmartView{}
+	for _, view := range views {
+		if view.Username == username {
+			result = append(result, view)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return c.JSON(result)
+}
+
+func deleteView(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	viewID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	view, exists := views[viewID]
+	if !exists || view.Username != username {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "view not found"})
+	}
+	delete(views, viewID)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// runView returns the tasks currently matching a view. It takes the same
+// sort, limit and cursor parameters as GET /api/tasks, plus ?tz= for the
+// time zone that "today" and "this week" are counted in.
+func runView(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	viewID := c.Params("id")
+
+	query, err := parseTaskQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	loc, err := time.LoadLocation(c.Query("tz", "UTC"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown time zone"})
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	view, exists := views[viewID]
+	if !exists || view.Username != username {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "view not found"})
+	}
+	filter, err := compileFilter(view.Query)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "stored query is invalid"})
+	}
+
+	now := time.Now().In(loc)
+	query.Predicate = func(task Task) bool { return filter(task, now) }
+
+	return c.JSON(fiber.Map{"view": view, "result": query.run(visibleTasks(username))})
+}
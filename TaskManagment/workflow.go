@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	StatusTodo       = "todo"
+	StatusInProgress = "in_progress"
+	StatusBlocked    = "blocked"
+	StatusDone       = "done"
+	StatusCancelled  = "cancelled"
+)
+
+// allowedTransitions is the task workflow, todo -> in_progress -> done with
+// blocked and cancelled on the side. Done tasks can be reopened and cancelled
+// ones brought back.
+var allowedTransitions = map[string][]string{
+	StatusTodo:       {StatusInProgress, StatusBlocked, StatusCancelled},
+	StatusInProgress: {StatusDone, StatusBlocked, StatusTodo, StatusCancelled},
+	StatusBlocked:    {StatusTodo, StatusInProgress, StatusCancelled},
+	StatusDone:       {StatusInProgress},
+	StatusCancelled:  {StatusTodo},
+}
+
+// statuses a task may be created with
+var initialStatuses = []string{StatusTodo, StatusInProgress, StatusBlocked}
+
+type StatusChange struct {
+	From string    `json:"from,omitempty"` // empty for the status the task was created with
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// TransitionError is returned for a status move the workflow doesn't allow
+type TransitionError struct {
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *TransitionError) Error() string {
+	if _, known := allowedTransitions[e.To]; !known {
+		return fmt.Sprintf("unknown status %q", e.To)
+	}
+	if e.From == "" {
+		return fmt.Sprintf("a new task cannot start as %s", e.To)
+	}
+	return fmt.Sprintf("cannot move task from %s to %s", e.From, e.To)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTransition validates a status move, from is empty for a new task
+func checkTransition(from, to string) error {
+	allowed := initialStatuses
+	if from != "" {
+		allowed = allowedTransitions[from]
+	}
+	if !contains(allowed, to) {
+		return &TransitionError{From: from, To: to, Allowed: allowed}
+	}
+	return nil
+}
+
+// recordStatus appends a history entry when the status changed
+func recordStatus(task *Task, from string, at time.Time) {
+	if task.Status == from {
+		return
+	}
+	history := make([]StatusChange, len(task.History), len(task.History)+1)
+	copy(history, task.History)
+	task.History = append(history, StatusChange{From: from, To: task.Status, At: at})
+}
+
+func transitionErrorResponse(c *fiber.Ctx, err error) error {
+	body := fiber.Map{"error": err.Error()}
+	if transitionErr, ok := err.(*TransitionError); ok {
+		body["allowed"] = transitionErr.Allowed
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(body)
+}
+
+// cycleTime is the time from first starting work on a task to finishing it.
+// It is only known once the task is done.
+func cycleTime(task Task) (time.Duration, bool) {
+	if task.Status != StatusDone {
+		return 0, false
+	}
+	var started, finished time.Time
+	for _, change := range task.History {
+		if change.To == StatusInProgress && started.IsZero() {
+			started = change.At
+		}
+		if change.To == StatusDone {
+			finished = change.At
+		}
+	}
+	if started.IsZero() || finished.IsZero() {
+		return 0, false
+	}
+	return finished.Sub(started), true
+}
+
+func getTaskHistory(c *fiber.Ctx) error {
+	username := c.Locals("user").(string)
+	taskID := c.Params("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	task, err := accessTask(username, taskID, RoleViewer)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	result := fiber.Map{"status": task.Status, "history": task.History}
+	if duration, ok := cycleTime(task); ok {
+		result["cycle_time"] = duration.String()
+		result["cycle_time_seconds"] = int64(duration.Seconds())
+	}
+	return c.JSON(result)
+}